@@ -2,23 +2,41 @@ package httpd
 
 import (
 	"bufio"
-	"errors"
+	"bytes"
+	"fmt"
 	"io"
 )
 
+// 单个块的大小上限，同时防止解析块大小时溢出
+const maxChunkSize = 1<<31 - 1
+
 // 处理chunk编码传输的报文
 type chunkReader struct {
 	//当前正在处理的块中还剩多少字节未读
 	n    int
 	bufr *bufio.Reader
+	//报文所属的请求，读到结尾时将trailer存入req.Trailer
+	req *Request
 	//利用done来记录报文主体是否读取完毕
 	done bool
+	//读取时发生的错误，之后的读取都返回该错误，避免在出错的位置之后继续解析
+	err  error
 	crlf [2]byte //用来读取\r\n
 }
 
 // 实现io.Reader 接口
 func (c *chunkReader) Read(p []byte) (n int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err = c.read(p)
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return
+}
 
+func (c *chunkReader) read(p []byte) (n int, err error) {
 	// 如果读完了就不读了
 	if c.done {
 		return 0, io.EOF
@@ -30,30 +48,29 @@ func (c *chunkReader) Read(p []byte) (n int, err error) {
 		if err != nil {
 			return 0, err
 		}
+		// 大小为0的块是最后一个块，之后是trailer
+		if c.n == 0 {
+			if err = c.readTrailer(); err != nil {
+				return 0, err
+			}
+			c.done = true
+			return 0, io.EOF
+		}
 	}
 
-	// 如果还是0 说明报文已经读取完毕了
-	if c.n == 0 {
-		c.done = true
-		// 再次去除最后的 "\r\n"
-		err = c.discardCRLF()
-		return
+	// 最多读到当前块的末尾
+	if len(p) > c.n {
+		p = p[:c.n]
 	}
-
-	// 如果当前块剩余的数据大于欲读取的长度
-	if len(p) <= c.n {
-		n, err = c.bufr.Read(p)
-		c.n -= n
-		return n, err
+	n, err = c.bufr.Read(p)
+	c.n -= n
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
 	}
 
-	//如果当前块剩余的数据不够欲读取的长度，将剩余的数据全部取出返回
-	n, _ = io.ReadFull(c.bufr, p[:c.n])
-	c.n = 0
-
 	//记得把每个chunkData后的\r\n消费掉
-	if err = c.discardCRLF(); err != nil {
-		return
+	if err == nil && c.n == 0 {
+		err = c.discardCRLF()
 	}
 	return
 }
@@ -62,30 +79,112 @@ func (c *chunkReader) Read(p []byte) (n int, err error) {
 func (c *chunkReader) discardCRLF() (err error) {
 	if _, err = io.ReadFull(c.bufr, c.crlf[:]); err == nil {
 		if c.crlf[0] != '\r' || c.crlf[1] != '\n' {
-			return errors.New("unsupported encoding format of chunk")
+			return ErrBadChunkEncoding
 		}
 	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	return
 }
 
-// 获取下一个chunk块的大小
+// 获取下一个chunk块的大小。块大小之后可以跟着以';'开头的扩展（chunk-ext），
+// 如"1a;name=value"，扩展没有约定好的语义，直接忽略
 func (c *chunkReader) getChunkSize() (chunkSize int, err error) {
-	line, err := readLine(c.bufr)
+	// 块大小所在的行不受MaxHeaderBytes的约束，超过读缓存的长度就视为格式错误
+	line, err := c.bufr.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return 0, fmt.Errorf("%w: chunk size line too long", ErrBadChunkEncoding)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return
 	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("%w: %v", ErrBadChunkEncoding, errBadLineEnding)
+	}
+	line = line[:len(line)-2]
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	// 块大小与扩展之间允许有空白（BWS）
+	line = bytes.TrimRight(line, " \t")
+	if len(line) == 0 {
+		return 0, fmt.Errorf("%w: missing chunk size", ErrBadChunkEncoding)
+	}
 	//将16进制换算成10进制
 	for i := 0; i < len(line); i++ {
+		var d int
 		switch {
 		case 'a' <= line[i] && line[i] <= 'f':
-			chunkSize = chunkSize*16 + int(line[i]-'a') + 10
+			d = int(line[i]-'a') + 10
 		case 'A' <= line[i] && line[i] <= 'F':
-			chunkSize = chunkSize*16 + int(line[i]-'A') + 10
+			d = int(line[i]-'A') + 10
 		case '0' <= line[i] && line[i] <= '9':
-			chunkSize = chunkSize*16 + int(line[i]-'0')
+			d = int(line[i] - '0')
 		default:
-			return 0, errors.New("illegal hex number")
+			return 0, fmt.Errorf("%w: illegal hex number %q", ErrBadChunkEncoding, line)
+		}
+		if chunkSize > (maxChunkSize-d)/16 {
+			return 0, fmt.Errorf("%w: chunk size %q too large", ErrBadChunkEncoding, line)
 		}
+		chunkSize = chunkSize*16 + d
 	}
 	return
 }
+
+// 读取最后一个块之后的trailer，与请求首部一样受MaxHeaderBytes的约束
+func (c *chunkReader) readTrailer() error {
+	conn := c.req.conn
+	conn.lr.N = conn.svr.maxHeaderBytes()
+	trailer, err := readHeader(c.bufr)
+	if err != nil && conn.hitHeaderLimit() {
+		err = ErrHeaderTooLarge
+	}
+	conn.lr.N = noLimit
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	for k := range trailer {
+		if forbiddenTrailer[k] {
+			delete(trailer, k)
+		}
+	}
+	if len(trailer) > 0 {
+		c.req.Trailer = trailer
+	}
+	return nil
+}
+
+// 不允许出现在trailer中的字段：决定报文边界、路由、认证以及需要在处理报文主体之前知道的字段（RFC 9110 6.5.1节）
+var forbiddenTrailer = map[string]bool{
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Cookie":              true,
+	"Expect":              true,
+	"Host":                true,
+	"If-Match":            true,
+	"If-Modified-Since":   true,
+	"If-None-Match":       true,
+	"If-Range":            true,
+	"If-Unmodified-Since": true,
+	"Keep-Alive":          true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authorization": true,
+	"Range":               true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
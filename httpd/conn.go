@@ -2,44 +2,117 @@ package httpd
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// 连接所处的状态
+type ConnState int
+
+const (
+	// 刚建立的连接，还没有读到任何请求数据
+	StateNew ConnState = iota
+	// 正在读取请求或处理请求
+	StateActive
+	// 处理完一个请求，等待下一个请求的长连接
+	StateIdle
+	// 连接已被handler接管，服务器不再管理该连接
+	StateHijacked
+	// 连接已关闭
+	StateClosed
+)
+
+var stateName = map[ConnState]string{
+	StateNew:      "new",
+	StateActive:   "active",
+	StateIdle:     "idle",
+	StateHijacked: "hijacked",
+	StateClosed:   "closed",
+}
+
+func (c ConnState) String() string {
+	return stateName[c]
+}
+
 // 每个连接的服务 以及底层的tcp连接
 type conn struct {
 	svr  *Server
 	rwc  net.Conn
-	lr   *io.LimitedReader
-	bufr *bufio.Reader //bufr是对lr的封装
-	bufw *bufio.Writer // 使用带缓存的写入
+	r    *connReader       //r是对rwc的封装
+	lr   *io.LimitedReader //lr是对r的封装
+	bufr *bufio.Reader     //bufr是对lr的封装
+	bufw *bufio.Writer     // 使用带缓存的写入
+
+	// 取消该连接上所有请求的Context，读连接出错（如客户端断开）时调用
+	cancelCtx context.CancelFunc
+
+	// 对端IP，用于MaxConnsPerIP计数
+	remoteIP string
+	// 连接是否已被handler接管
+	hijacked bool
+
+	// TLS连接握手完成后的状态，非TLS连接为nil
+	tlsState *tls.ConnectionState
+
+	// 低8位存储ConnState，其余位存储进入该状态时的unix时间戳
+	curState atomic.Uint64
 }
 
 func newConn(rwc net.Conn, svr *Server) *conn {
-	lr := &io.LimitedReader{R: rwc, N: 1 << 20}
-	return &conn{
+	c := &conn{
 		svr:  svr,
 		rwc:  rwc,
-		lr:   lr,
-		bufr: bufio.NewReaderSize(rwc, 4<<10),
 		bufw: bufio.NewWriterSize(rwc, 4<<10),
 	}
+	c.r = &connReader{conn: c}
+	c.lr = &io.LimitedReader{R: c.r, N: svr.maxHeaderBytes()}
+	c.bufr = bufio.NewReaderSize(c.lr, 4<<10)
+	return c
 }
 
-func (c *conn) serve() {
+func (c *conn) serve(ctx context.Context) {
+	ctx, cancelCtx := context.WithCancel(ctx)
+	c.cancelCtx = cancelCtx
+	defer cancelCtx()
+
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("panic recoverred,err:%v\n", err)
+			c.svr.logf("httpd: panic serving %s: %v", c.rwc.RemoteAddr(), err)
+		}
+		if !c.hijacked {
+			c.close()
+			c.setState(StateClosed)
 		}
-		c.close()
 	}()
 
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		if !c.handshake(tlsConn) {
+			return
+		}
+	}
+
 	// 使用for 循环支持一个长连接 不断的读取请求
-	for {
+	for first := true; ; first = false {
+		// 等待请求的第一个字节到达，期间连接处于空闲(或新建)状态
+		// 第一个请求受头部读取超时的约束，长连接上的后续请求受空闲超时的约束
+		c.setWaitDeadline(first)
+		// 限制请求行与首部的大小，读完首部后readRequest会取消该限制
+		c.lr.N = c.svr.maxHeaderBytes()
+		if _, err := c.bufr.Peek(1); err != nil {
+			return
+		}
+		c.setState(StateActive)
+
 		// 读取request请求
-		req, err := c.readRequest()
+		req, cancelReq, err := c.readRequest(ctx)
 
 		// 处理请求的错误
 		if err != nil {
@@ -50,11 +123,30 @@ func (c *conn) serve() {
 		// 设置响应
 		res := c.setUpResponse(req)
 
+		// 没有报文主体的请求，handler运行期间就可以在后台读取连接，及时发现客户端断开
+		if _, ok := req.Body.(*eofReader); ok {
+			c.r.startBackgroundRead()
+		}
+
 		// 直接使用回调函数
-		c.svr.Handler.ServeHttp(res, req)
+		panicked, abort := c.callHandler(res, req)
+		if c.hijacked {
+			cancelReq()
+			return
+		}
+		c.r.abortPendingRead()
+		if panicked {
+			// 响应已经部分发送或者handler主动中止，只能直接关闭连接
+			if abort || !res.resetForError(StatusInternalServerError) {
+				cancelReq()
+				return
+			}
+		}
 
 		// 结束请求的操作
-		if err = req.finishRequest(res); err != nil {
+		err = req.finishRequest(res)
+		cancelReq()
+		if err != nil {
 			return
 		}
 
@@ -62,23 +154,257 @@ func (c *conn) serve() {
 		if res.closeAfterReply {
 			return
 		}
+		c.setState(StateIdle)
+
+		//服务正在关闭，不再处理该连接上的后续请求
+		if c.svr.shuttingDown() {
+			return
+		}
 	}
 }
 
+// 调用Handler处理请求，并捕获handler中的panic
+// panicked表示handler发生了panic，abort表示panic的值为ErrAbortHandler
+func (c *conn) callHandler(w *response, r *Request) (panicked, abort bool) {
+	// handler返回之后临时文件就不再需要了，panic、中止与接管连接时serve会提前返回，所以在这里删除
+	defer r.removeTempFiles()
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+		panicked = true
+		if err == ErrAbortHandler {
+			abort = true
+			return
+		}
+		const size = 64 << 10
+		buf := make([]byte, size)
+		buf = buf[:runtime.Stack(buf, false)]
+		c.svr.logf("httpd: panic serving %s: %v\n%s", c.rwc.RemoteAddr(), err, buf)
+	}()
+	c.svr.Handler.ServeHttp(w, r)
+	return
+}
+
+// 处理读取请求时发生的错误：协议错误与超时回复相应的状态码，其他错误记录到日志中
 func handleErr(err error, c *conn) {
-	fmt.Println(err)
+	// 客户端在发完请求之前关闭了连接
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	// 客户端没能在规定时间内发完请求
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.writeErrorResponse(StatusRequestTimeout)
+		return
+	}
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		c.writeErrorResponse(pe.StatusCode)
+		return
+	}
+	c.svr.logf("httpd: error reading request from %s: %v", c.rwc.RemoteAddr(), err)
+}
+
+// 写错误响应时允许的最长时间，避免卡在不读数据的客户端上
+const errorWriteTimeout = 5 * time.Second
+
+// 在请求未能正常解析的情况下，直接在连接上写一个简单的错误响应，写完后连接将被关闭
+func (c *conn) writeErrorResponse(code int) {
+	text := fmt.Sprintf("%d %s", code, statusText[code])
+	c.rwc.SetWriteDeadline(time.Now().Add(errorWriteTimeout))
+	fmt.Fprintf(c.bufw, "HTTP/1.1 %s\r\nContent-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\nConnection: close\r\n\r\n%s", text, len(text), text)
+	c.bufw.Flush()
+}
+
+// 设置等待下一个请求时的读超时
+func (c *conn) setWaitDeadline(first bool) {
+	d := c.svr.idleTimeout()
+	if first {
+		d = c.svr.readHeaderTimeout()
+	}
+	if d != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+	} else {
+		c.rwc.SetReadDeadline(time.Time{})
+	}
 }
 
 func (c *conn) close() { c.rwc.Close() }
 
-func (c *conn) readRequest() (r *Request, err error) {
+// 切换连接状态，新建和关闭时登记到Server中，以便Shutdown能够找到它
+// 每个连接的StateHijacked与StateClosed只会出现其中一个，并且只出现一次
+func (c *conn) setState(state ConnState) {
+	switch state {
+	case StateNew:
+		c.svr.trackConn(c, true)
+	case StateHijacked, StateClosed:
+		c.svr.trackConn(c, false)
+		c.svr.releaseConnSlot()
+		c.svr.releaseIP(c.remoteIP)
+	}
+	packed := uint64(time.Now().Unix()<<8) | uint64(state)
+	c.curState.Store(packed)
+	if hook := c.svr.ConnState; hook != nil {
+		hook(c.rwc, state)
+	}
+}
+
+// 拒绝一个刚接收的连接：回复一个错误响应后关闭
+func (c *conn) reject(code int) {
+	c.writeErrorResponse(code)
+	c.close()
+}
+
+func (c *conn) getState() (state ConnState, unixSec int64) {
+	packed := c.curState.Load()
+	return ConnState(packed & 0xff), int64(packed >> 8)
+}
+
+func (c *conn) readRequest(ctx context.Context) (r *Request, cancel context.CancelFunc, err error) {
+	t0 := time.Now()
+	// 请求头部需要在ReadHeaderTimeout内读完
+	if d := c.svr.readHeaderTimeout(); d != 0 {
+		c.rwc.SetReadDeadline(t0.Add(d))
+	}
+	// 写超时从读完请求头部开始计算
+	if d := c.svr.WriteTimeout; d != 0 {
+		defer func() {
+			c.rwc.SetWriteDeadline(time.Now().Add(d))
+		}()
+	}
+
 	r, err = readRequest(c)
+	if err != nil {
+		return
+	}
+	// 报文主体的读取受ReadTimeout的约束，没有设置则取消头部的截止时间
+	if d := c.svr.ReadTimeout; d != 0 {
+		c.rwc.SetReadDeadline(t0.Add(d))
+	} else {
+		c.rwc.SetReadDeadline(time.Time{})
+	}
 	// 解析表单的类型
 	r.parseContentType()
+	r.ctx, cancel = context.WithCancel(ctx)
 	return
 
 }
 
+// lr读到了上限并且缓存中的数据也已耗尽，说明正在读取的请求头部超出了MaxHeaderBytes
+func (c *conn) hitHeaderLimit() bool {
+	return c.lr.N <= 0 && c.bufr.Buffered() == 0
+}
+
 func (c *conn) setUpResponse(req *Request) *response {
 	return setupResponse(c, req)
 }
+
+// 一个很久以前的时间，设置为读截止时间可以让阻塞中的Read立即返回
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader位于lr与rwc之间。读完报文主体之后handler还在运行时，
+// connReader在后台从连接上读取一个字节，以便及时发现客户端断开连接并取消请求的Context；
+// 读到的字节会保留下来，作为下一个请求的开头。
+type connReader struct {
+	conn *conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	hasByte bool    //后台读取读到了一个字节
+	byteBuf [1]byte //后台读取读到的字节
+	inRead  bool    //是否有Read正在进行
+	aborted bool    //后台读取是否被abortPendingRead中止
+}
+
+func (cr *connReader) lock() {
+	cr.mu.Lock()
+	if cr.cond == nil {
+		cr.cond = sync.NewCond(&cr.mu)
+	}
+}
+
+func (cr *connReader) unlock() { cr.mu.Unlock() }
+
+// 开始后台读取，调用时报文主体必须已经读完
+func (cr *connReader) startBackgroundRead() {
+	cr.lock()
+	defer cr.unlock()
+	if cr.inRead {
+		panic("httpd: invalid concurrent Body.Read call")
+	}
+	if cr.hasByte {
+		return
+	}
+	cr.inRead = true
+	cr.conn.rwc.SetReadDeadline(time.Time{})
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.conn.rwc.Read(cr.byteBuf[:])
+	cr.lock()
+	if n == 1 {
+		cr.hasByte = true
+	}
+	if ne, ok := err.(net.Error); ok && cr.aborted && ne.Timeout() {
+		//由abortPendingRead主动中止，不是真正的错误
+	} else if err != nil {
+		cr.handleReadError(err)
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.unlock()
+	cr.cond.Broadcast()
+}
+
+// 中止后台读取并等待其返回，handler结束后连接要继续读取下一个请求
+func (cr *connReader) abortPendingRead() {
+	cr.lock()
+	defer cr.unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.conn.rwc.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.rwc.SetReadDeadline(time.Time{})
+}
+
+// 读连接出错说明客户端已经断开或者连接已经不可用，取消该连接上请求的Context
+func (cr *connReader) handleReadError(_ error) {
+	cr.conn.cancelCtx()
+}
+
+func (cr *connReader) Read(p []byte) (n int, err error) {
+	cr.lock()
+	if cr.inRead {
+		cr.unlock()
+		panic("httpd: invalid concurrent Body.Read call")
+	}
+	if len(p) == 0 {
+		cr.unlock()
+		return 0, nil
+	}
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.unlock()
+		return 1, nil
+	}
+	cr.inRead = true
+	cr.unlock()
+	n, err = cr.conn.rwc.Read(p)
+
+	cr.lock()
+	cr.inRead = false
+	if err != nil {
+		cr.handleReadError(err)
+	}
+	cr.unlock()
+	cr.cond.Broadcast()
+	return n, err
+}
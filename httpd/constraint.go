@@ -0,0 +1,76 @@
+package httpd
+
+import (
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+// 参数段的约束，"int"与"uuid"为内置的类型约束，其余按正则表达式处理，
+// 正则表达式需要匹配整个段
+type constraint struct {
+	expr  string
+	match func(seg string) bool
+}
+
+// 解析"{name:expr}"中的expr
+func parseConstraint(expr string) (*constraint, error) {
+	switch expr {
+	case "":
+		return nil, errors.New("empty parameter constraint")
+	case "int":
+		return &constraint{expr: expr, match: func(seg string) bool {
+			_, err := strconv.Atoi(seg)
+			return err == nil
+		}}, nil
+	case "uuid":
+		return &constraint{expr: expr, match: func(seg string) bool {
+			_, err := parseUUID(seg)
+			return err == nil
+		}}, nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, errors.New("bad parameter constraint " + expr + ": " + err.Error())
+	}
+	return &constraint{expr: expr, match: re.MatchString}, nil
+}
+
+// 约束的原始写法，没有约束时为空
+func (c *constraint) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.expr
+}
+
+// RFC 9562定义的UUID，由Request.PathUUID返回
+type UUID [16]byte
+
+// 按"xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"的形式输出
+func (u UUID) String() string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+// 解析"xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"形式的UUID，不区分大小写
+func parseUUID(s string) (u UUID, err error) {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return u, errors.New("httpd: invalid UUID " + strconv.Quote(s))
+	}
+	src := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	if _, err = hex.Decode(u[:], []byte(src)); err != nil {
+		return u, errors.New("httpd: invalid UUID " + strconv.Quote(s))
+	}
+	return u, nil
+}
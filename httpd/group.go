@@ -0,0 +1,82 @@
+package httpd
+
+import (
+	"net/url"
+	"strings"
+)
+
+// 中间件：对Handler进行包装，在其前后加入日志、鉴权等通用的处理逻辑
+type Middleware func(Handler) Handler
+
+// 路由组：通过组注册的模式自动加上组的前缀，handler外层依次套上组的中间件。
+// 由ServeMux.Group创建，组内还可以继续创建子组
+type RouteGroup struct {
+	mux         *ServeMux
+	prefix      string
+	middlewares []Middleware
+}
+
+func (g *RouteGroup) HandleFunc(pattern string, cb HandlerFunc, middlewares ...Middleware) *Route {
+	return g.mux.HandleFunc(g.fullPattern(pattern), cb, g.with(middlewares)...)
+}
+
+// 同ServeMux.Handle，组的中间件位于middlewares之外
+func (g *RouteGroup) Handle(pattern string, handler Handler, middlewares ...Middleware) *Route {
+	return g.mux.Handle(g.fullPattern(pattern), handler, g.with(middlewares)...)
+}
+
+// 同ServeMux.Mount，prefix相对于组的前缀
+func (g *RouteGroup) Mount(prefix string, h Handler, middlewares ...Middleware) *Route {
+	return g.mux.Mount(g.prefix+strings.TrimSuffix(prefix, "/"), h, g.with(middlewares)...)
+}
+
+// 创建子组，子组的前缀与中间件接在当前组之后
+func (g *RouteGroup) Group(prefix string, middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{mux: g.mux, prefix: g.prefix + strings.TrimSuffix(prefix, "/"), middlewares: g.with(middlewares)}
+}
+
+// 组的中间件之后接上middlewares
+func (g *RouteGroup) with(middlewares []Middleware) []Middleware {
+	mws := make([]Middleware, 0, len(g.middlewares)+len(middlewares))
+	mws = append(mws, g.middlewares...)
+	return append(mws, middlewares...)
+}
+
+// 给模式的路径部分加上组的前缀，保留模式中的请求方法
+func (g *RouteGroup) fullPattern(pattern string) string {
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		return pattern[:i] + " " + g.prefix + strings.TrimLeft(pattern[i+1:], " \t")
+	}
+	return g.prefix + pattern
+}
+
+// 去掉请求路径的前n段后交给h处理
+func stripSegments(n int, h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		path := r.URL.EscapedPath()
+		i := 0
+		for k := 0; k < n && i >= 0; k++ {
+			if j := strings.IndexByte(path[i+1:], '/'); j >= 0 {
+				i += j + 1
+			} else {
+				i = -1
+			}
+		}
+		rest, prefix := "/", path
+		if i >= 0 {
+			rest, prefix = path[i:], path[:i]
+		}
+		u := new(url.URL)
+		*u = *r.URL
+		u.Path, u.RawPath = rest, ""
+		// 路径中含有转义字符时，Path保存解码后的路径，RawPath保存原始的形式
+		if p, err := url.PathUnescape(rest); err == nil && p != rest {
+			u.Path, u.RawPath = p, rest
+		}
+		r2 := new(Request)
+		*r2 = *r
+		r2.URL = u
+		r2.mountPrefix = r.mountPrefix + prefix
+		h.ServeHttp(w, r2)
+	})
+}
@@ -1,26 +1,96 @@
 package httpd
 
+import (
+	"bufio"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// 首部字段，键为规范形式（见CanonicalHeaderKey）的字段名。
+// 通过Add、Set、Get、Del等方法访问时会自动转换字段名，直接读写map时需要自行使用规范形式
 type Header map[string][]string
 
+// 返回字段名的规范形式：首字母以及'-'之后的字母大写，其余小写，如"content-length"变为"Content-Length"。
+// 含有空格或其他非法字符的字段名原样返回
+func CanonicalHeaderKey(s string) string {
+	return textproto.CanonicalMIMEHeaderKey(s)
+}
+
+// 给字段追加一个值
 func (h Header) Add(key, value string) {
+	key = CanonicalHeaderKey(key)
 	h[key] = append(h[key], value)
 }
 
 // 插入键值对
 func (h Header) Set(key, value string) {
-	h[key] = []string{value}
+	h[CanonicalHeaderKey(key)] = []string{value}
 }
 
 // 获取值，key不存在则返回空
 func (h Header) Get(key string) string {
-	if value, ok := h[key]; ok && len(value) > 0 {
+	if value, ok := h[CanonicalHeaderKey(key)]; ok && len(value) > 0 {
 		return value[0]
 	} else {
 		return ""
 	}
 }
 
+// 获取字段的全部值，返回的切片与Header共享
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
 // 删除键
 func (h Header) Del(key string) {
-	delete(h, key)
+	delete(h, CanonicalHeaderKey(key))
+}
+
+// 深拷贝，h为nil时返回nil
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	h2 := make(Header, len(h))
+	for k, vs := range h {
+		h2[k] = append([]string(nil), vs...)
+	}
+	return h2
+}
+
+// 值中的CR、LF替换为空格，防止handler设置的值注入额外的首部或者提前结束头部
+var headerValueSanitizer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// 按字段名排序后写出所有字段，每个值单独占一行。字段名不合法的字段会被跳过
+func (h Header) write(w *bufio.Writer) error {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		if validHeaderKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			v = strings.TrimSpace(headerValueSanitizer.Replace(v))
+			if _, err := w.WriteString(k + ": " + v + "\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 字段名必须是非空的token
+func validHeaderKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if !isTokenChar(k[i]) {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,84 @@
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+)
+
+// 一条注册路由的描述信息，由ServeMux.Routes返回
+type RouteInfo struct {
+	Pattern string `json:"pattern"`
+	// 路由处理的请求方法，为空表示处理所有方法
+	Methods []string `json:"methods"`
+	Name    string   `json:"name,omitempty"`
+	// 请求经过的中间件（函数名），从外到内依次为Use注册的中间件与该路由的中间件
+	Middlewares []string `json:"middlewares"`
+}
+
+// 按注册顺序返回全部路由的描述信息，可用于启动时检查路由或者生成文档
+func (sm *ServeMux) Routes() []RouteInfo {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	infos := make([]RouteInfo, 0, len(sm.routes))
+	for _, rt := range sm.routes {
+		info := RouteInfo{Pattern: rt.pattern, Name: rt.name, Middlewares: []string{}}
+		if rt.method != "" {
+			info.Methods = []string{rt.method}
+			if rt.method == "GET" {
+				info.Methods = append(info.Methods, "HEAD")
+			}
+		}
+		for _, mw := range sm.middlewares {
+			info.Middlewares = append(info.Middlewares, funcName(mw))
+		}
+		for _, mw := range rt.middlewares {
+			info.Middlewares = append(info.Middlewares, funcName(mw))
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// 返回以表格形式列出全部路由的Handler，请求的Accept包含application/json
+// 或者查询参数format=json时输出JSON，可以挂载到/debug/routes等调试路径下
+func (sm *ServeMux) RoutesHandler() Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		routes := sm.Routes()
+		if r.Query("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(routes)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "PATTERN\tMETHODS\tNAME\tMIDDLEWARES")
+		for _, rt := range routes {
+			methods := "*"
+			if len(rt.Methods) > 0 {
+				methods = strings.Join(rt.Methods, ",")
+			}
+			name := rt.Name
+			if name == "" {
+				name = "-"
+			}
+			mws := strings.Join(rt.Middlewares, " > ")
+			if mws == "" {
+				mws = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rt.Pattern, methods, name, mws)
+		}
+		tw.Flush()
+	})
+}
+
+// 取得中间件的函数名，闭包形式的中间件为外层函数名加上".func1"之类的后缀
+func funcName(mw Middleware) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(mw).Pointer()); f != nil {
+		return f.Name()
+	}
+	return "unknown"
+}
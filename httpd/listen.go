@@ -0,0 +1,124 @@
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 根据地址创建listener，地址支持以下几种形式：
+//
+//	"host:port"           tcp地址
+//	"unix:/path/to/sock"  unix domain socket
+//	"fd:3"                继承自父进程的文件描述符
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return listenUnix(strings.TrimPrefix(addr, "unix:"))
+	case strings.HasPrefix(addr, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(addr, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("httpd: invalid listener fd in %q", addr)
+		}
+		return fileListener(uintptr(fd))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// 监听unix domain socket，如果socket文件是上次运行残留下来的则先将其删除
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// 能连上说明还有进程在使用这个socket，交给net.Listen报错
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// 由文件描述符得到listener，net.FileListener会复制fd，原来的fd随即关闭
+func fileListener(fd uintptr) (net.Listener, error) {
+	f := os.NewFile(fd, "listener-"+strconv.Itoa(int(fd)))
+	if f == nil {
+		return nil, fmt.Errorf("httpd: invalid listener fd %d", fd)
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// systemd的socket激活协议中，传递的第一个fd固定为3
+const listenFdsStart = 3
+
+var (
+	inheritedOnce sync.Once
+	inherited     []net.Listener
+	inheritedErr  error
+)
+
+// 返回按照systemd socket激活协议（LISTEN_PID、LISTEN_FDS环境变量）由父进程传递下来的listener。
+// 父进程没有传递listener时返回nil。这些环境变量在第一次调用后被清除，避免被子进程继承，
+// 之后的调用返回相同的结果。
+//
+// 平滑重启时，旧进程把自己的listener按照同样的方式交给新进程，
+// 新进程在这些listener上调用Server.Serve，旧进程再调用Shutdown即可。
+func InheritedListeners() ([]net.Listener, error) {
+	inheritedOnce.Do(func() {
+		inherited, inheritedErr = inheritListeners()
+	})
+	return inherited, inheritedErr
+}
+
+func inheritListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	// LISTEN_PID不是当前进程，说明这些fd不是传给我们的
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	nfds := os.Getenv("LISTEN_FDS")
+	if nfds == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(nfds)
+	if err != nil || n < 0 {
+		return nil, errors.New("httpd: invalid LISTEN_FDS " + strconv.Quote(nfds))
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		l, err := fileListener(uintptr(fd))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// 保证listener只被关闭一次：Serve返回时与Shutdown都会关闭listener
+type onceCloseListener struct {
+	net.Listener
+	once     sync.Once
+	closeErr error
+}
+
+func (oc *onceCloseListener) Close() error {
+	oc.once.Do(func() {
+		oc.closeErr = oc.Listener.Close()
+	})
+	return oc.closeErr
+}
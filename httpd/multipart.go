@@ -98,7 +98,7 @@ func (m *MultipartReader) readLine() ([]byte, error) {
 
 func (m *MultipartReader) ReadForm() (mf *MultipartForm, err error) {
 	mf = &MultipartForm{
-		Value: make(map[string]string),
+		Value: make(Values),
 		File:  make(map[string]*FileHeader),
 	}
 	//非文件部分在内存中存取的最大量10MB,超出返回错误
@@ -137,7 +137,7 @@ func (m *MultipartReader) ReadForm() (mf *MultipartForm, err error) {
 			if nonFileMaxMemory < 0 {
 				return nil, errors.New("multipart: message too large")
 			}
-			mf.Value[part.FormName()] = buff.String()
+			mf.Value.Add(part.FormName(), buff.String())
 			continue
 		}
 		//文件表单项处理
@@ -185,7 +185,7 @@ func (m *MultipartReader) ReadForm() (mf *MultipartForm, err error) {
 }
 
 type MultipartForm struct {
-	Value map[string]string
+	Value Values
 	File  map[string]*FileHeader
 }
 
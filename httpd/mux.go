@@ -0,0 +1,572 @@
+package httpd
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 路由器：以路径段（两个'/'之间的部分）为单位组织成一棵前缀树。
+// 模式中的每一段可以是：
+//
+//	静态段  /users         按内容精确匹配
+//	参数段  /users/{id}    匹配任意一个非空的段，可以通过Request.PathValue("id")取得
+//	约束参数段 /orders/{id:[0-9]+}、{id:int}、{id:uuid}  只匹配满足约束的段
+//	通配段  /files/{path...}  只能是最后一段，匹配剩余的全部路径（可以为空）
+//	子树    /api/          以'/'结尾的模式匹配该前缀下的所有路径，相当于匿名的通配段
+//
+// 同一位置的优先级为：静态段 > 约束参数段（按注册顺序） > 参数段 > 通配段。
+// 优先级高的分支匹配失败时，会回溯尝试其他分支。
+// 同一位置的参数名由各条路由自己决定，如"GET /users/{id}"与"DELETE /users/{uid}"可以同时注册；
+// 两个模式的方法相同并且能匹配完全相同的路径时视为冲突，注册时直接panic。
+//
+// 模式前可以加上请求方法，如"GET /items"、"POST /items"，不带方法的模式匹配所有方法。
+// 路径匹配但方法不匹配时回复405并在Allow首部中列出允许的方法；
+// GET路由同时处理HEAD请求（响应不含报文主体）；没有注册OPTIONS路由时自动回复允许的方法。
+//
+// 模式的路径前可以加上主机名，如"api.example.com/v1/"，或者通配主机名，如"*.example.com/"，
+// 通配主机名匹配任意层级的子域名。匹配时忽略Host首部中的端口并且不区分大小写，
+// 依次尝试精确的主机名、通配主机名（后缀越长越优先）、不带主机名的模式。
+//
+// 匹配之前先清理请求路径中的"."、".."与连续的'/'，路径不规范时重定向到清理后的路径。
+// 请求路径只差末尾的'/'时的处理方式由TrailingSlash决定。
+//
+// 通过Use注册的中间件作用于路由器处理的所有请求（包括404与405），
+// 注册路由时传入的中间件只作用于该路由，位于Use的中间件之内。
+type ServeMux struct {
+	// 请求路径与模式只差末尾的'/'时的处理方式，默认为TrailingSlashRedirect
+	TrailingSlash TrailingSlashPolicy
+	// 没有匹配的路由时调用，为nil时根据Accept首部回复纯文本、HTML或JSON格式的404
+	NotFound Handler
+	// 路径匹配但方法不匹配时调用，调用前已经设置好Allow首部；为nil时回复默认的405
+	MethodNotAllowed Handler
+
+	mu          sync.RWMutex
+	routes      []*Route          // 按注册顺序排列的全部路由
+	named       map[string]*Route // 命名的路由
+	root        *node             // 不带主机名的模式
+	hosts       map[string]*node  // 带主机名的模式，以小写的主机名为键
+	wildHosts   []wildHost        // 带通配主机名的模式，按后缀长度从长到短排列
+	middlewares []Middleware
+}
+
+// 请求路径与模式只差末尾的'/'时的处理方式
+type TrailingSlashPolicy int
+
+const (
+	// 重定向到注册的形式，如请求"/a/"而注册的是"/a"，或者请求"/api"而注册的是子树"/api/"
+	TrailingSlashRedirect TrailingSlashPolicy = iota
+	// 严格匹配，直接回复404
+	TrailingSlashStrict
+	// 不重定向，直接交给注册的路由处理
+	TrailingSlashLenient
+)
+
+// 通配主机名"*.example.com"对应的路由树
+type wildHost struct {
+	suffix string // ".example.com"
+	root   *node
+}
+
+// 前缀树的节点，每个节点对应模式中的一段
+type node struct {
+	static   map[string]*node  // 静态子节点，以段的内容（已解码）为键
+	params   []*node           // 参数子节点，带约束的在前，不带约束的（最多一个）在最后
+	wildcard *node             // 通配子节点
+	check    *constraint       // 参数段的约束，为nil表示不带约束
+	routes   map[string]*Route // 在此节点结束的路由，以请求方法为键，""表示匹配所有方法
+}
+
+// 一条注册的路由，由Handle返回，可以通过Name命名以便ServeMux.URL反向生成URL
+type Route struct {
+	mux     *ServeMux
+	pattern string
+	method  string
+	segs    []patternSegment
+	name    string
+	// 模式中参数段与通配段的参数名，与匹配得到的值按顺序对应
+	paramNames []string
+	// 该路由专属的中间件，handler已经套上了这些中间件
+	middlewares []Middleware
+	handler     Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{root: &node{}}
+}
+
+func (sm *ServeMux) HandleFunc(pattern string, cb HandlerFunc, middlewares ...Middleware) *Route {
+	if cb == nil {
+		panic("httpd: nil handler for pattern " + pattern)
+	}
+	return sm.Handle(pattern, cb, middlewares...)
+}
+
+// 注册路由，middlewares只作用于该路由，第一个中间件位于最外层
+func (sm *ServeMux) Handle(pattern string, handler Handler, middlewares ...Middleware) *Route {
+	if handler == nil {
+		panic("httpd: nil handler for pattern " + pattern)
+	}
+	method, host, segs, err := parsePattern(pattern)
+	if err != nil {
+		panic("httpd: invalid pattern " + pattern + ": " + err.Error())
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	rt := &Route{mux: sm, pattern: pattern, method: method, segs: segs,
+		middlewares: middlewares, handler: chain(handler, middlewares)}
+	n := sm.tree(host)
+	for _, seg := range segs {
+		if seg.kind != segStatic {
+			rt.paramNames = append(rt.paramNames, seg.name)
+		}
+		n = n.child(seg)
+	}
+	if old := n.routes[method]; old != nil {
+		panic("httpd: pattern " + pattern + " conflicts with " + old.pattern)
+	}
+	if n.routes == nil {
+		n.routes = make(map[string]*Route)
+	}
+	n.routes[method] = rt
+	sm.routes = append(sm.routes, rt)
+	return rt
+}
+
+// 取得主机名对应的路由树，不存在时创建
+func (sm *ServeMux) tree(host string) *node {
+	if host == "" {
+		if sm.root == nil {
+			sm.root = &node{}
+		}
+		return sm.root
+	}
+	if strings.HasPrefix(host, "*.") {
+		suffix := host[1:]
+		for _, wh := range sm.wildHosts {
+			if wh.suffix == suffix {
+				return wh.root
+			}
+		}
+		wh := wildHost{suffix: suffix, root: &node{}}
+		sm.wildHosts = append(sm.wildHosts, wh)
+		sort.SliceStable(sm.wildHosts, func(i, j int) bool {
+			return len(sm.wildHosts[i].suffix) > len(sm.wildHosts[j].suffix)
+		})
+		return wh.root
+	}
+	if sm.hosts == nil {
+		sm.hosts = make(map[string]*node)
+	}
+	if sm.hosts[host] == nil {
+		sm.hosts[host] = &node{}
+	}
+	return sm.hosts[host]
+}
+
+// 取得节点上处理method的路由，HEAD请求可以由GET路由处理
+func (n *node) routeFor(method string) *Route {
+	if rt := n.routes[method]; rt != nil {
+		return rt
+	}
+	if method == "HEAD" {
+		if rt := n.routes["GET"]; rt != nil {
+			return rt
+		}
+	}
+	return n.routes[""]
+}
+
+// 将节点上注册的方法加入allowed
+func (n *node) allowedMethods(allowed map[string]bool) {
+	for method := range n.routes {
+		allowed[method] = true
+		if method == "GET" {
+			allowed["HEAD"] = true
+		}
+	}
+	allowed["OPTIONS"] = true
+}
+
+// 取得seg对应的子节点，不存在时创建。参数名只记录在路由的paramNames中，
+// 同一位置约束相同的参数段（以及通配段）共用一个节点
+func (n *node) child(seg patternSegment) *node {
+	switch seg.kind {
+	case segStatic:
+		if n.static == nil {
+			n.static = make(map[string]*node)
+		}
+		c := n.static[seg.name]
+		if c == nil {
+			c = &node{}
+			n.static[seg.name] = c
+		}
+		return c
+	case segParam:
+		// 约束不同的参数段按约束依次尝试
+		for _, c := range n.params {
+			if c.check.String() == seg.check.String() {
+				return c
+			}
+		}
+		c := &node{check: seg.check}
+		if seg.check == nil || len(n.params) == 0 || n.params[len(n.params)-1].check != nil {
+			n.params = append(n.params, c)
+		} else {
+			// 不带约束的参数段始终放在最后
+			last := len(n.params) - 1
+			n.params = append(n.params[:last], c, n.params[last])
+		}
+		return c
+	default:
+		if n.wildcard == nil {
+			n.wildcard = &node{}
+		}
+		return n.wildcard
+	}
+}
+
+// 在以n为根的子树中匹配segs，values收集沿途参数段与通配段的值。
+// 路径匹配但没有处理method的路由时，将该节点允许的方法加入allowed并继续回溯
+func (n *node) match(segs []string, values []string, method string, allowed map[string]bool) (*Route, []string) {
+	if len(segs) == 0 {
+		return n.matchMethod(values, method, allowed)
+	}
+	seg := segs[0]
+	if c := n.static[seg]; c != nil {
+		if rt, vs := c.match(segs[1:], values, method, allowed); rt != nil {
+			return rt, vs
+		}
+	}
+	if seg != "" {
+		for _, c := range n.params {
+			if c.check != nil && !c.check.match(seg) {
+				continue
+			}
+			if rt, vs := c.match(segs[1:], append(values, seg), method, allowed); rt != nil {
+				return rt, vs
+			}
+		}
+	}
+	if n.wildcard != nil {
+		return n.wildcard.matchMethod(append(values, strings.Join(segs, "/")), method, allowed)
+	}
+	return nil, nil
+}
+
+func (n *node) matchMethod(values []string, method string, allowed map[string]bool) (*Route, []string) {
+	if len(n.routes) == 0 {
+		return nil, nil
+	}
+	if rt := n.routeFor(method); rt != nil {
+		return rt, values
+	}
+	n.allowedMethods(allowed)
+	return nil, nil
+}
+
+// 根据主机名、请求路径与方法查找路由。没有找到路由时，allowed为路径匹配的路由所允许的方法
+func (sm *ServeMux) lookup(host, path, method string) (rt *Route, params map[string]string, allowed map[string]bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	allowed = make(map[string]bool)
+	var values []string
+	// 依次在各棵候选的路由树中查找，某棵树的路径匹配（即使方法不匹配）就不再尝试后面的树
+	for _, root := range sm.candidateTrees(host) {
+		rt, values = root.match(splitPath(path), nil, method, allowed)
+		if rt != nil || len(allowed) > 0 {
+			break
+		}
+	}
+	if rt == nil {
+		return nil, nil, allowed
+	}
+	if len(values) > 0 {
+		params = make(map[string]string, len(values))
+		for i, name := range rt.paramNames {
+			// 子树模式的匿名通配段不记录
+			if name != "" {
+				params[name] = values[i]
+			}
+		}
+	}
+	return rt, params, nil
+}
+
+// 按优先级返回可能匹配请求主机名的路由树
+func (sm *ServeMux) candidateTrees(host string) []*node {
+	host = normalizeHost(host)
+	trees := make([]*node, 0, 3)
+	if n := sm.hosts[host]; n != nil && host != "" {
+		trees = append(trees, n)
+	}
+	for _, wh := range sm.wildHosts {
+		if len(host) > len(wh.suffix) && strings.HasSuffix(host, wh.suffix) {
+			trees = append(trees, wh.root)
+		}
+	}
+	if sm.root != nil {
+		trees = append(trees, sm.root)
+	}
+	return trees
+}
+
+// 去掉主机名中的端口与末尾的'.'，并转换为小写
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (sm *ServeMux) ServeHttp(w ResponseWriter, r *Request) {
+	h := sm.handler(r)
+	sm.mu.RLock()
+	mws := sm.middlewares
+	sm.mu.RUnlock()
+	chain(h, mws).ServeHttp(w, r)
+}
+
+// 添加作用于所有请求的中间件，先添加的位于外层
+func (sm *ServeMux) Use(middlewares ...Middleware) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.middlewares = append(sm.middlewares, middlewares...)
+}
+
+// 找到处理请求的Handler，并设置请求的路径参数
+func (sm *ServeMux) handler(r *Request) Handler {
+	path := r.URL.EscapedPath()
+	if clean := cleanPath(path); clean != path {
+		return redirectHandler(clean)
+	}
+	// 查看路由树中是否存在对应的路由
+	rt, params, allowed := sm.lookup(r.Host, path, r.Method)
+	// 请求路径只差末尾的'/'，按TrailingSlash的设置处理
+	if rt == nil && len(allowed) == 0 && path != "/" && sm.TrailingSlash != TrailingSlashStrict {
+		alt := path + "/"
+		if strings.HasSuffix(path, "/") {
+			alt = path[:len(path)-1]
+		}
+		if rt2, params2, allowed2 := sm.lookup(r.Host, alt, r.Method); rt2 != nil || len(allowed2) > 0 {
+			if sm.TrailingSlash == TrailingSlashRedirect {
+				return redirectHandler(alt)
+			}
+			rt, params, allowed = rt2, params2, allowed2
+		}
+	}
+	if rt == nil {
+		if len(allowed) == 0 {
+			if sm.NotFound != nil {
+				return sm.NotFound
+			}
+			return HandlerFunc(func(w ResponseWriter, r *Request) {
+				writeProblem(w, r, StatusNotFound)
+			})
+		}
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			w.Header().Set("Allow", allowHeader(allowed))
+			// 没有注册OPTIONS路由，直接告知客户端允许的方法
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(StatusNoContent)
+				return
+			}
+			if sm.MethodNotAllowed != nil {
+				sm.MethodNotAllowed.ServeHttp(w, r)
+				return
+			}
+			writeProblem(w, r, StatusMethodNotAllowed)
+		})
+	}
+	r.pathValues = mergePathValues(r.pathValues, params)
+	return rt.handler
+}
+
+// 重定向到规范的路径，保留查询字符串。GET与HEAD使用301，其他方法使用308以保留方法与报文主体
+func redirectHandler(path string) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		// 挂载的子路由器看到的是去掉前缀的路径，重定向时要补上前缀
+		loc := r.mountPrefix + path
+		if r.URL.RawQuery != "" {
+			loc += "?" + r.URL.RawQuery
+		}
+		code := StatusPermanentRedirect
+		if r.Method == "GET" || r.Method == "HEAD" {
+			code = StatusMovedPermanently
+		}
+		w.Header().Set("Location", loc)
+		w.WriteHeader(code)
+	})
+}
+
+// 清理路径中的"."、".."与连续的'/'，保留末尾的'/'
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := pathpkg.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// 给h依次套上中间件，第一个中间件位于最外层
+func chain(h Handler, middlewares []Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// 挂载的子路由器匹配到的参数与外层路由器匹配到的参数合并在一起
+func mergePathValues(outer, inner map[string]string) map[string]string {
+	if len(outer) == 0 {
+		return inner
+	}
+	merged := make(map[string]string, len(outer)+len(inner))
+	for k, v := range outer {
+		merged[k] = v
+	}
+	for k, v := range inner {
+		merged[k] = v
+	}
+	return merged
+}
+
+// 将h挂载到prefix下：prefix之下的所有请求都交给h处理，h看到的请求路径去掉了prefix。
+// prefix中可以包含参数段，匹配到的参数在h中同样可以通过PathValue取得
+func (sm *ServeMux) Mount(prefix string, h Handler, middlewares ...Middleware) *Route {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return sm.Handle(prefix+"/", stripSegments(strings.Count(prefix, "/"), h), middlewares...)
+}
+
+// 创建一个路由组，通过组注册的模式自动加上prefix，handler外层依次套上middlewares
+func (sm *ServeMux) Group(prefix string, middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{mux: sm, prefix: strings.TrimSuffix(prefix, "/"), middlewares: middlewares}
+}
+
+// 将允许的方法排序后拼接成Allow首部的值
+func allowHeader(allowed map[string]bool) string {
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// 将转义形式的路径切分成段，并逐段解码
+func splitPath(path string) []string {
+	if path == "" {
+		path = "/"
+	}
+	segs := strings.Split(path[1:], "/")
+	for i, seg := range segs {
+		if u, err := url.PathUnescape(seg); err == nil {
+			segs[i] = u
+		}
+	}
+	return segs
+}
+
+// 模式中段的种类
+const (
+	segStatic = iota
+	segParam
+	segWildcard
+)
+
+type patternSegment struct {
+	kind int
+	// 静态段为段的内容，参数段与通配段为参数名
+	name string
+	// 参数段的约束
+	check *constraint
+}
+
+// 解析路由模式，模式的格式为"[METHOD ][HOST]/PATH"
+func parsePattern(pattern string) (method, host string, segs []patternSegment, err error) {
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		method, pattern = pattern[:i], strings.TrimLeft(pattern[i+1:], " \t")
+		if !validMethod(method) {
+			return "", "", nil, errors.New("bad method " + method)
+		}
+	}
+	i := strings.IndexByte(pattern, '/')
+	if i < 0 {
+		return "", "", nil, errors.New("pattern must contain a path beginning with '/'")
+	}
+	host, pattern = normalizeHost(pattern[:i]), pattern[i:]
+	if strings.ContainsAny(host, "{}") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return "", "", nil, errors.New("bad host " + host)
+	}
+	parts := strings.Split(pattern[1:], "/")
+	segs = make([]patternSegment, 0, len(parts))
+	seen := make(map[string]bool)
+	for i, part := range parts {
+		// 以'/'结尾的模式匹配整棵子树
+		if part == "" && i == len(parts)-1 {
+			segs = append(segs, patternSegment{kind: segWildcard})
+			continue
+		}
+		if !strings.HasPrefix(part, "{") {
+			if strings.ContainsAny(part, "{}") {
+				return "", "", nil, errors.New("a parameter must be a whole segment: " + part)
+			}
+			if u, err := url.PathUnescape(part); err == nil {
+				part = u
+			}
+			segs = append(segs, patternSegment{kind: segStatic, name: part})
+			continue
+		}
+		if !strings.HasSuffix(part, "}") {
+			return "", "", nil, errors.New("a parameter must be a whole segment: " + part)
+		}
+		name := part[1 : len(part)-1]
+		seg := patternSegment{kind: segParam, name: name}
+		if j := strings.IndexByte(name, ':'); j >= 0 {
+			if seg.check, err = parseConstraint(name[j+1:]); err != nil {
+				return "", "", nil, err
+			}
+			seg.name = name[:j]
+		} else if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return "", "", nil, errors.New("wildcard {" + name + "} must be the last segment")
+			}
+			seg = patternSegment{kind: segWildcard, name: strings.TrimSuffix(name, "...")}
+		}
+		if !isValidParamName(seg.name) {
+			return "", "", nil, errors.New("bad parameter name {" + name + "}")
+		}
+		if seen[seg.name] {
+			return "", "", nil, errors.New("duplicate parameter name " + seg.name)
+		}
+		seen[seg.name] = true
+		segs = append(segs, seg)
+	}
+	return method, host, segs, nil
+}
+
+// 参数名只能由字母、数字与下划线组成，且不能以数字开头
+func isValidParamName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !(i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
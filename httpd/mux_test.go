@@ -0,0 +1,210 @@
+package httpd
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+)
+
+// 记录handler写入的响应，用于在不建立连接的情况下测试路由器
+type recorder struct {
+	code   int
+	header Header
+	body   bytes.Buffer
+}
+
+func newRecorder() *recorder { return &recorder{code: StatusOK, header: Header{}} }
+
+func (rec *recorder) Header() Header              { return rec.header }
+func (rec *recorder) Write(p []byte) (int, error) { return rec.body.Write(p) }
+func (rec *recorder) WriteHeader(statusCode int)  { rec.code = statusCode }
+
+// 用sm处理一个请求，target为请求行中的URI
+func serve(t *testing.T, sm *ServeMux, method, target string) *recorder {
+	t.Helper()
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		t.Fatalf("bad target %q: %v", target, err)
+	}
+	rec := newRecorder()
+	sm.ServeHttp(rec, &Request{Method: method, URL: u, RequestURI: target, Header: Header{}})
+	return rec
+}
+
+// 返回一个写出tag与指定路径参数的handler
+func echo(tag string, names ...string) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		w.Write([]byte(tag))
+		for _, name := range names {
+			w.Write([]byte(" " + name + "=" + r.PathValue(name)))
+		}
+	}
+}
+
+func TestParamConstraints(t *testing.T) {
+	sm := NewServeMux()
+	sm.HandleFunc("/files/{path...}", echo("files", "path"))
+	sm.HandleFunc("/orders/{id:int}", echo("int", "id"))
+	sm.HandleFunc("/orders/{id:uuid}", echo("uuid", "id"))
+	sm.HandleFunc("/orders/{slug}", echo("slug", "slug"))
+	sm.HandleFunc("/zip/{code:[0-9]{5}}", echo("zip", "code"))
+
+	tests := []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/files/a/b/c.txt", StatusOK, "files path=a/b/c.txt"},
+		{"/files/", StatusOK, "files path="},
+		{"/orders/42", StatusOK, "int id=42"},
+		{"/orders/-7", StatusOK, "int id=-7"},
+		{"/orders/6ba7b810-9dad-11d1-80b4-00c04fd430c8", StatusOK, "uuid id=6ba7b810-9dad-11d1-80b4-00c04fd430c8"},
+		{"/orders/abc", StatusOK, "slug slug=abc"},
+		{"/orders/99999999999999999999999", StatusOK, "slug slug=99999999999999999999999"},
+		{"/zip/12345", StatusOK, "zip code=12345"},
+		{"/zip/1234", StatusNotFound, ""},
+		{"/zip/123456", StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := serve(t, sm, "GET", tt.target)
+		if rec.code != tt.code {
+			t.Errorf("GET %s: code = %d, want %d", tt.target, rec.code, tt.code)
+			continue
+		}
+		if tt.code == StatusOK && rec.body.String() != tt.body {
+			t.Errorf("GET %s: body = %q, want %q", tt.target, rec.body.String(), tt.body)
+		}
+	}
+}
+
+func TestPathIntAndUUID(t *testing.T) {
+	r := &Request{pathValues: map[string]string{"n": "12", "u": "6BA7B810-9DAD-11D1-80B4-00C04FD430C8", "bad": "x"}}
+	if n, err := r.PathInt("n"); err != nil || n != 12 {
+		t.Errorf("PathInt(n) = %d, %v", n, err)
+	}
+	if _, err := r.PathInt("bad"); err == nil {
+		t.Error("PathInt(bad): expected error")
+	}
+	if _, err := r.PathInt("missing"); err == nil {
+		t.Error("PathInt(missing): expected error")
+	}
+	u, err := r.PathUUID("u")
+	if err != nil || u.String() != "6ba7b810-9dad-11d1-80b4-00c04fd430c8" {
+		t.Errorf("PathUUID(u) = %v, %v", u, err)
+	}
+	if _, err := r.PathUUID("bad"); err == nil {
+		t.Error("PathUUID(bad): expected error")
+	}
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{
+		"/files/{path...}/x",
+		"/a/{x:}",
+		"/a/{x:[}",
+		"/a/{1x}",
+		"/a/{x}/{x}",
+		"no-slash",
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Handle(%q): expected panic", pattern)
+				}
+			}()
+			NewServeMux().HandleFunc(pattern, echo("x"))
+		}()
+	}
+}
+
+func TestRoutePrecedence(t *testing.T) {
+	sm := NewServeMux()
+	sm.HandleFunc("/users/new", echo("static"))
+	sm.HandleFunc("/users/{id:int}", echo("int", "id"))
+	sm.HandleFunc("/users/{name}", echo("param", "name"))
+	sm.HandleFunc("/users/{rest...}", echo("catchall", "rest"))
+	// 回溯：静态分支/a/b之下没有c，需要退回参数分支
+	sm.HandleFunc("/a/b", echo("ab"))
+	sm.HandleFunc("/a/{x}/c", echo("axc", "x"))
+	// 回溯：参数分支之下没有匹配时退回通配分支
+	sm.HandleFunc("/p/{x}/end", echo("pxend", "x"))
+	sm.HandleFunc("/p/{rest...}", echo("prest", "rest"))
+
+	tests := []struct {
+		target string
+		body   string
+	}{
+		{"/users/new", "static"},
+		{"/users/42", "int id=42"},
+		{"/users/bob", "param name=bob"},
+		{"/users/bob/posts", "catchall rest=bob/posts"},
+		{"/users/", "catchall rest="},
+		{"/a/b", "ab"},
+		{"/a/b/c", "axc x=b"},
+		{"/p/1/end", "pxend x=1"},
+		{"/p/1/other", "prest rest=1/other"},
+	}
+	for _, tt := range tests {
+		rec := serve(t, sm, "GET", tt.target)
+		if rec.code != StatusOK || rec.body.String() != tt.body {
+			t.Errorf("GET %s = %d %q, want 200 %q", tt.target, rec.code, rec.body.String(), tt.body)
+		}
+	}
+}
+
+// 不同方法的路由在同一位置可以使用不同的参数名
+func TestParamNamesPerMethod(t *testing.T) {
+	sm := NewServeMux()
+	sm.HandleFunc("GET /users/{id}", echo("get", "id", "uid"))
+	sm.HandleFunc("DELETE /users/{uid}", echo("delete", "id", "uid"))
+	sm.HandleFunc("GET /files/{path...}", echo("get", "path", "p"))
+	sm.HandleFunc("PUT /files/{p...}", echo("put", "path", "p"))
+
+	for _, tt := range []struct {
+		method, target, body string
+	}{
+		{"GET", "/users/7", "get id=7 uid="},
+		{"DELETE", "/users/7", "delete id= uid=7"},
+		{"GET", "/files/a/b", "get path=a/b p="},
+		{"PUT", "/files/a/b", "put path= p=a/b"},
+	} {
+		rec := serve(t, sm, tt.method, tt.target)
+		if rec.code != StatusOK || rec.body.String() != tt.body {
+			t.Errorf("%s %s = %d %q, want 200 %q", tt.method, tt.target, rec.code, rec.body.String(), tt.body)
+		}
+	}
+	rec := serve(t, sm, "POST", "/users/7")
+	if rec.code != StatusMethodNotAllowed || rec.header.Get("Allow") != "DELETE, GET, HEAD, OPTIONS" {
+		t.Errorf("POST /users/7 = %d Allow=%q", rec.code, rec.header.Get("Allow"))
+	}
+}
+
+// 方法相同并且匹配完全相同的路径的两个模式互相冲突
+func TestRouteConflicts(t *testing.T) {
+	for _, tt := range []struct{ first, second string }{
+		{"/users/{id}", "/users/{uid}"},
+		{"GET /users/{id}", "GET /users/{uid}"},
+		{"/users/{id:int}", "/users/{n:int}"},
+		{"/files/{a...}", "/files/{b...}"},
+		{"/api/", "/api/{rest...}"},
+		{"/x", "/x"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %q after %q: expected panic", tt.second, tt.first)
+				}
+			}()
+			sm := NewServeMux()
+			sm.HandleFunc(tt.first, echo("1"))
+			sm.HandleFunc(tt.second, echo("2"))
+		}()
+	}
+	// 约束不同或者方法不同的模式不冲突
+	sm := NewServeMux()
+	sm.HandleFunc("/users/{id:int}", echo("1"))
+	sm.HandleFunc("/users/{id:uuid}", echo("2"))
+	sm.HandleFunc("/users/{id}", echo("3"))
+	sm.HandleFunc("GET /items/{id}", echo("4"))
+	sm.HandleFunc("POST /items/{item}", echo("5"))
+}
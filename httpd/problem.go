@@ -0,0 +1,80 @@
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// 路由器默认的404与405响应：根据请求的Accept首部选择纯文本、HTML
+// 或者RFC 9457定义的application/problem+json格式的报文主体
+func writeProblem(w ResponseWriter, r *Request, code int) {
+	title := statusText[code]
+	var detail string
+	switch code {
+	case StatusNotFound:
+		detail = "no route matches " + r.URL.Path
+	case StatusMethodNotAllowed:
+		detail = "method " + r.Method + " is not allowed for " + r.URL.Path
+	}
+
+	switch negotiateProblemType(r.Header.Get("Accept")) {
+	case "application/problem+json":
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(struct {
+			Type     string `json:"type"`
+			Title    string `json:"title"`
+			Status   int    `json:"status"`
+			Detail   string `json:"detail"`
+			Instance string `json:"instance"`
+		}{"about:blank", title, code, detail, r.URL.Path})
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%d %s</title></head>\n"+
+			"<body><h1>%d %s</h1><p>%s</p></body></html>\n",
+			code, title, code, title, html.EscapeString(detail))
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "%d %s: %s\n", code, title, detail)
+	}
+}
+
+// 按Accept首部中的q值，从纯文本、HTML、JSON中选出客户端最想要的格式，
+// 没有Accept首部或者都不接受时使用纯文本
+func negotiateProblemType(accept string) string {
+	best, bestQ := "text/plain", 0.0
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		var typ string
+		switch mediaType {
+		case "application/problem+json", "application/json":
+			typ = "application/problem+json"
+		case "text/html":
+			typ = "text/html"
+		case "text/plain", "text/*", "*/*":
+			typ = "text/plain"
+		default:
+			continue
+		}
+		// q值相同时先出现的优先
+		if q > bestQ {
+			best, bestQ = typ, q
+		}
+	}
+	return best
+}
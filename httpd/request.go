@@ -3,6 +3,8 @@ package httpd
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +14,34 @@ import (
 	"strings"
 )
 
+// 解析请求报文时发生的协议错误，StatusCode为应当回复给客户端的状态码
+type ProtocolError struct {
+	StatusCode  int
+	ErrorString string
+}
+
+func (pe *ProtocolError) Error() string { return pe.ErrorString }
+
+var (
+	// 请求行格式错误
+	ErrBadRequestLine = &ProtocolError{StatusBadRequest, "malformed request line"}
+	// 首部格式错误
+	ErrBadHeader = &ProtocolError{StatusBadRequest, "malformed header"}
+	// 不支持的协议版本，只支持HTTP/1.x
+	ErrUnsupportedVersion = &ProtocolError{StatusHTTPVersionNotSupported, "unsupported HTTP version"}
+	// 不支持的Transfer-Encoding，只支持chunked
+	ErrUnsupportedTransferEncoding = &ProtocolError{StatusNotImplemented, "unsupported transfer encoding"}
+	// chunk编码格式错误
+	ErrBadChunkEncoding = &ProtocolError{StatusBadRequest, "malformed chunked encoding"}
+	// 请求行超出了MaxHeaderBytes的限制
+	ErrRequestLineTooLong = &ProtocolError{StatusRequestURITooLong, "request line too long"}
+	// 请求行加上首部超出了MaxHeaderBytes的限制
+	ErrHeaderTooLarge = &ProtocolError{statusRequestHeaderFieldsTooLarge, "request header too large"}
+)
+
+// 读取报文主体时lr的上限，相当于不限制
+const noLimit = (1 << 63) - 1
+
 type eofReader struct{}
 
 // 实现了io.Reader接口
@@ -24,28 +54,42 @@ type Request struct {
 	Method string
 	//URL
 	URL *url.URL
-	//协议以及版本
-	Proto string
+	//请求的主机名，可能带有端口，取自请求行中的绝对URI或者Host首部
+	Host string
+	//协议以及版本，如"HTTP/1.1"
+	Proto      string
+	ProtoMajor int
+	ProtoMinor int
 	//首部字段
 	Header Header
+	//chunk编码的报文主体之后的trailer字段，Body读到EOF之后才会被填充，没有trailer时为nil
+	Trailer Header
 	//用于读取报文主体
 	Body io.Reader
 	// 客户端地址
 	RemoteAddr string
 	//字符串形式的url
 	RequestURI string
+	//TLS连接的状态，非TLS连接为nil
+	TLS *tls.ConnectionState
 	//产生此request的http连接
 	conn *conn
+	//请求的Context，客户端断开连接或者服务关闭时被取消
+	ctx context.Context
 	//存储cookie	私有化
 	cookies map[string]string
+	//路由匹配得到的路径参数
+	pathValues map[string]string
+	//Mount去掉的路径前缀（转义形式），子路由器重定向时需要补上
+	mountPrefix string
 	//存储queryString	私有化
-	queryString map[string]string
+	queryString Values
 	//body的类型
 	contentType string
 	//表单边界的标志
 	boundary string
 	//post请求的表单
-	postForm map[string]string
+	postForm Values
 	//存储传输的文件信息
 	multipartForm *MultipartForm
 	//是否已经解析过表单
@@ -58,23 +102,30 @@ func readRequest(c *conn) (r *Request, err error) {
 	r = new(Request)
 	r.conn = c
 	r.RemoteAddr = c.rwc.RemoteAddr().String()
+	r.TLS = c.tlsState
 
 	//读出第一行,如：Get /index?name=gu HTTP/1.1
-	line, err := readLine(c.bufr)
+	line, err := readCRLFLine(c.bufr)
+	// 请求行被lr截断，说明请求行过长
+	if c.hitHeaderLimit() {
+		return r, ErrRequestLineTooLong
+	}
+	if err == errBadLineEnding {
+		return r, fmt.Errorf("%w: %v", ErrBadRequestLine, err)
+	}
 	if err != nil {
 		return
 	}
 
 	// 按空格分割就得到了三个属性
-	_, err = fmt.Sscanf(string(line), "%s%s%s", &r.Method, &r.RequestURI, &r.Proto)
-	if err != nil {
+	if err = r.parseRequestLine(string(line)); err != nil {
 		return
 	}
 
 	// 将字符串形式的URI变成url.URL形式
 	r.URL, err = url.ParseRequestURI(r.RequestURI)
 	if err != nil {
-		return
+		return r, fmt.Errorf("%w: %v", ErrBadRequestLine, err)
 	}
 
 	//解析queryString
@@ -83,16 +134,95 @@ func readRequest(c *conn) (r *Request, err error) {
 	//读header
 	r.Header, err = readHeader(c.bufr)
 	if err != nil {
+		if c.hitHeaderLimit() {
+			err = ErrHeaderTooLarge
+		}
 		return
 	}
-	const noLimit = (1 << 63) - 1
+	r.Host = r.URL.Host
+	if r.Host == "" {
+		r.Host = r.Header.Get("Host")
+	}
 	r.conn.lr.N = noLimit //Body的读取无需进行读取字节数限制
 
 	//设置body
-	r.setupBody()
+	if err = r.setupBody(); err != nil {
+		return
+	}
 	return r, nil
 }
 
+// 解析请求行，请求行的三个部分之间只能以单个空格分隔
+func (r *Request) parseRequestLine(line string) error {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !validMethod(parts[0]) || parts[1] == "" {
+		return fmt.Errorf("%w: %q", ErrBadRequestLine, line)
+	}
+	r.Method, r.RequestURI, r.Proto = parts[0], parts[1], parts[2]
+
+	var ok bool
+	if r.ProtoMajor, r.ProtoMinor, ok = parseHTTPVersion(r.Proto); !ok {
+		return fmt.Errorf("%w: %q", ErrBadRequestLine, line)
+	}
+	if r.ProtoMajor != 1 {
+		return fmt.Errorf("%w: %s", ErrUnsupportedVersion, r.Proto)
+	}
+	return nil
+}
+
+// 方法名必须由token字符组成
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for i := 0; i < len(method); i++ {
+		if !isTokenChar(method[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// RFC 9110中token允许的字符
+func isTokenChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", b) != -1
+}
+
+// 解析"HTTP/1.1"形式的协议版本
+func parseHTTPVersion(proto string) (major, minor int, ok bool) {
+	// 版本号只能是单个数字，形如HTTP/x.y
+	if len(proto) != len("HTTP/x.y") || !strings.HasPrefix(proto, "HTTP/") || proto[6] != '.' {
+		return 0, 0, false
+	}
+	if proto[5] < '0' || proto[5] > '9' || proto[7] < '0' || proto[7] > '9' {
+		return 0, 0, false
+	}
+	return int(proto[5] - '0'), int(proto[7] - '0'), true
+}
+
+// 返回请求的Context，客户端断开连接、服务关闭或者handler返回后，该Context会被取消
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// 返回一个使用ctx作为Context的浅拷贝
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("httpd: nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
 // 避免首部行超过缓存 所以将读取首部行的进行封装
 func readLine(bufr *bufio.Reader) ([]byte, error) {
 	// prefix 为bool类型 代表这一行是否超出了缓存 如果为true的话 表示缓存已满，一行未完全读取
@@ -112,23 +242,37 @@ func readLine(bufr *bufio.Reader) ([]byte, error) {
 	return p, err
 }
 
-// 解析queryString
-func (r *Request) parseQuery() {
-	r.queryString = parseQuery(r.URL.RawQuery)
-}
+// 行中出现了单独的CR或LF
+var errBadLineEnding = errors.New("line not terminated by CRLF")
 
-// 先以&符为分隔得到一个个k-v对，然后以=符为分割分别得到key以及value，存入map即可。
-func parseQuery(query string) map[string]string {
-	parts := strings.Split(query, "&")
-	queries := make(map[string]string, len(parts))
-	for _, part := range parts {
-		index := strings.IndexByte(part, '=')
-		if index == -1 || index == len(part)-1 {
+// 读取以CRLF结尾的一行，返回的数据不含CRLF。请求行与首部只接受CRLF作为行尾，
+// 单独的LF或CR在不同的实现之间有不同的解释，可被用于请求走私（RFC 9112 2.2节）
+func readCRLFLine(bufr *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		p, err := bufr.ReadSlice('\n')
+		line = append(line, p...)
+		if err == bufio.ErrBufferFull {
 			continue
 		}
-		queries[strings.TrimSpace(part[:index])] = strings.TrimSpace(part[index+1:])
+		if err != nil {
+			return line, err
+		}
+		break
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errBadLineEnding
 	}
-	return queries
+	line = line[:len(line)-2]
+	if bytes.IndexByte(line, '\r') >= 0 {
+		return nil, errBadLineEnding
+	}
+	return line, nil
+}
+
+// 解析queryString，无法解码的参数直接忽略
+func (r *Request) parseQuery() {
+	r.queryString, _ = parseQuery(r.URL.RawQuery)
 }
 
 // 读取报文的头部
@@ -136,8 +280,10 @@ func readHeader(bufr *bufio.Reader) (Header, error) {
 	header := Header{}
 
 	for {
-		line, err := readLine(bufr)
-
+		line, err := readCRLFLine(bufr)
+		if err == errBadLineEnding {
+			return nil, fmt.Errorf("%w: %v", ErrBadHeader, err)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -146,24 +292,65 @@ func readHeader(bufr *bufio.Reader) (Header, error) {
 		if len(line) == 0 {
 			break
 		}
+		// 以空白开头的行是已废弃的折行（obs-fold），RFC 9112 5.2节允许服务器直接拒绝
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("%w: obsolete line folding %q", ErrBadHeader, line)
+		}
 		index := bytes.IndexByte(line, ':')
 		if index == -1 {
-			return header, errors.New("unsupported protocol")
+			return header, fmt.Errorf("%w: %q", ErrBadHeader, line)
 		}
-		if index == len(line)-1 {
-			continue
+		// 字段名与冒号之间不允许有空白（RFC 9112 5.1节），字段名必须是token
+		if !validHeaderKey(string(line[:index])) {
+			return nil, fmt.Errorf("%w: invalid field name %q", ErrBadHeader, line[:index])
 		}
-
-		k, v := string(line[:index]), strings.TrimSpace(string(line[index+1:]))
+		// 值为空的字段同样保留，Content-Length等决定报文边界的字段为空时需要被setupBody拒绝
+		k, v := CanonicalHeaderKey(string(line[:index])), strings.TrimSpace(string(line[index+1:]))
 		header[k] = append(header[k], v)
 	}
 
 	return header, nil
 }
 
-// 查询queryString 将queryString设为只读的
+// 查询queryString 将queryString设为只读的，参数有多个值时返回第一个
 func (r *Request) Query(name string) string {
-	return r.queryString[name]
+	return r.queryString.Get(name)
+}
+
+// 取得查询字符串中的全部参数，返回值与请求共享，不应修改
+func (r *Request) QueryValues() Values {
+	return r.queryString
+}
+
+// 查询路由模式中参数段或通配段匹配到的值，参数不存在时返回空
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// 将路径参数解析为int，参数不存在或者不是合法的整数时返回错误
+func (r *Request) PathInt(name string) (int, error) {
+	v, ok := r.pathValues[name]
+	if !ok {
+		return 0, errors.New("httpd: no path parameter " + name)
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("httpd: path parameter %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// 将路径参数解析为UUID，参数不存在或者不是合法的UUID时返回错误
+func (r *Request) PathUUID(name string) (UUID, error) {
+	v, ok := r.pathValues[name]
+	if !ok {
+		return UUID{}, errors.New("httpd: no path parameter " + name)
+	}
+	u, err := parseUUID(v)
+	if err != nil {
+		return UUID{}, fmt.Errorf("httpd: path parameter %s: %w", name, err)
+	}
+	return u, nil
 }
 
 // 查询cookie Cookie也是只读的 并且使用懒加载的方式
@@ -206,32 +393,111 @@ func (r *Request) parseCookies() {
 	return
 }
 
-func (r *Request) setupBody() {
-	if r.Method != "POST" && r.Method != "PUT" {
-		r.Body = &eofReader{} //POST和PUT以外的方法不允许设置报文主体
-	} else if cl := r.Header.Get("Content-Length"); cl != "" {
+func (r *Request) setupBody() error {
+	//只支持chunked这一种传输编码，值为空的Transfer-Encoding同样不支持
+	hasTE := len(r.Header.Values("Transfer-Encoding")) > 0
+	if hasTE && !r.chunked() {
+		return fmt.Errorf("%w: %q", ErrUnsupportedTransferEncoding, r.transferEncoding())
+	}
+	cl, err := r.contentLength()
+	if err != nil {
+		return err
+	}
+	// 同时出现Content-Length与Transfer-Encoding时，前后两个服务器可能按不同的方式确定报文的边界，
+	// 这是请求走私最常见的手法，直接拒绝（RFC 9112 6.1节）
+	if cl != "" && hasTE {
+		return fmt.Errorf("%w: both Content-Length and Transfer-Encoding present", ErrBadHeader)
+	}
+	// 报文主体的有无与长度只由Content-Length与Transfer-Encoding决定，与请求方法无关（RFC 9112 6.3节）
+	if cl != "" {
 		//如果设置了Content-Length
 		contentLength, err := strconv.ParseInt(cl, 10, 64)
-		if err != nil {
-			r.Body = &eofReader{}
-			return
+		if err != nil || contentLength < 0 {
+			return fmt.Errorf("%w: invalid Content-Length %q", ErrBadHeader, cl)
 		}
 		// 允许Body最多读取contentLength的数据
 		r.Body = io.LimitReader(r.conn.bufr, contentLength)
 		r.fixExpectContinueReader()
 	} else if r.chunked() {
 		// 将读取报文设置为chunkReader
-		r.Body = &chunkReader{bufr: r.conn.bufr}
+		r.Body = &chunkReader{bufr: r.conn.bufr, req: r}
 		r.fixExpectContinueReader()
 	} else {
 		r.Body = &eofReader{}
 	}
+	if _, ok := r.Body.(*eofReader); !ok {
+		//报文主体读完之后，连接开始在后台检测客户端是否断开
+		r.Body = &body{src: r.Body, onHitEOF: r.conn.r.startBackgroundRead}
+	}
+	return nil
+}
+
+// 报文主体的最外层封装，第一次读到EOF时调用onHitEOF
+type body struct {
+	src      io.Reader
+	sawEOF   bool
+	onHitEOF func()
+	// 读取时遇到的第一个错误，handler忽略了该错误时finishRequest仍能据此回复错误
+	err error
+}
+
+func (b *body) Read(p []byte) (n int, err error) {
+	if b.sawEOF {
+		return 0, io.EOF
+	}
+	n, err = b.src.Read(p)
+	if err == io.EOF {
+		b.sawEOF = true
+		if b.onHitEOF != nil {
+			b.onHitEOF()
+		}
+	} else if err != nil && b.err == nil {
+		b.err = err
+	}
+	return
 }
 
 // 检查此报文的body是否使用chunk编码方式传输
 func (r *Request) chunked() bool {
-	chunk := r.Header.Get("Transfer-Encoding")
-	return chunk == "chunked"
+	return strings.EqualFold(r.transferEncoding(), "chunked")
+}
+
+// 所有Transfer-Encoding字段的值合并在一起，多个字段等同于一个以逗号分隔的列表
+func (r *Request) transferEncoding() string {
+	return strings.Join(r.Header.Values("Transfer-Encoding"), ", ")
+}
+
+// 取得Content-Length的值。值只能由数字组成（不允许正负号与空值），
+// 多个Content-Length字段（或者以逗号分隔的列表）的值必须完全相同，
+// 否则无法确定报文的边界，返回错误（RFC 9112 6.3节）
+func (r *Request) contentLength() (string, error) {
+	var cl string
+	for _, value := range r.Header.Values("Content-Length") {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if !isDigits(v) {
+				return "", fmt.Errorf("%w: invalid Content-Length %q", ErrBadHeader, value)
+			}
+			if cl != "" && v != cl {
+				return "", fmt.Errorf("%w: conflicting Content-Length %q and %q", ErrBadHeader, cl, v)
+			}
+			cl = v
+		}
+	}
+	return cl, nil
+}
+
+// s非空并且只由'0'到'9'组成
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
 }
 
 /*
@@ -269,12 +535,26 @@ func (r *Request) fixExpectContinueReader() {
 // 防止处理此次请求并未读取报文主体的情况
 // 对响应做一些处理
 func (r *Request) finishRequest(resp *response) (err error) {
-	// 删除所有在磁盘上的临时文件
-	if r.multipartForm != nil {
-		r.multipartForm.RemoveAll()
+	//handler已经结束，之后消费剩余数据时读到EOF不需要再开始后台读取
+	if b, ok := r.Body.(*body); ok {
+		b.onHitEOF = nil
 	}
 	//告诉chunkWriter handler已经结束
 	resp.handlerDone = true
+	//在发送响应头部之前处理handler没有读完的报文主体，以便需要关闭连接时能告知客户端
+	r.discardBody(resp)
+	//报文主体的编码有误（如chunk格式错误、trailer过大），无论handler是否读过报文主体，
+	//只要响应头部还没有发出，就改为回复对应的错误码，resetForError会同时关闭连接
+	if b, ok := r.Body.(*body); ok {
+		var pe *ProtocolError
+		if errors.As(b.err, &pe) {
+			resp.resetForError(pe.StatusCode)
+		}
+	}
+	//handler执行期间服务开始关闭，同样要告知客户端连接将被关闭
+	if r.conn.svr.shuttingDown() {
+		resp.closeAfterReply = true
+	}
 
 	//触发chunkWriter的Write方法，Write方法通过handlerDone来决定是用chunk还是Content-Length
 	if err = resp.bufw.Flush(); err != nil {
@@ -282,7 +562,7 @@ func (r *Request) finishRequest(resp *response) (err error) {
 	}
 
 	//如果是使用chunk编码，还需要将结束标识符传输
-	if resp.chunking {
+	if resp.chunking && resp.bodyAllowed() {
 		_, err = resp.c.bufw.WriteString("0\r\n\r\n")
 		if err != nil {
 			return
@@ -291,20 +571,49 @@ func (r *Request) finishRequest(resp *response) (err error) {
 
 	//如果用户的handler中未Write任何数据，我们手动触发(*chunkWriter).writeHeader
 	if !resp.cw.wrote {
-		resp.header.Set("Content-Length", "0")
+		//204与304响应不允许携带Content-Length
+		if resp.statusCode != StatusNoContent && resp.statusCode != StatusNotModified {
+			resp.header.Set("Content-Length", "0")
+		}
 		if err = resp.cw.writeHeader(); err != nil {
 			return
 		}
 	}
 
 	//将缓存中的剩余的数据发送到rwc中
-	if err = r.conn.bufw.Flush(); err != nil {
-		return
+	return r.conn.bufw.Flush()
+}
+
+// 删除解析multipart表单时暂时存储在磁盘上的文件
+func (r *Request) removeTempFiles() {
+	if r.multipartForm != nil {
+		r.multipartForm.RemoveAll()
 	}
-	//消费掉剩余的数据
-	_, err = io.Copy(ioutil.Discard, r.Body)
+}
 
-	return err
+// handler结束后最多替它读取并丢弃这么多的报文主体，剩余更多时直接关闭连接
+const maxDiscardBytes = 256 << 10
+
+// 读取并丢弃handler没有读完的报文主体，使连接停在下一个请求的开头。
+// 无法做到时（主体过大、读取出错、客户端还在等待100 Continue）设置closeAfterReply
+func (r *Request) discardBody(resp *response) {
+	if _, ok := r.Body.(*eofReader); ok {
+		return
+	}
+	if b, ok := r.Body.(*body); ok {
+		if b.sawEOF {
+			return
+		}
+		// 客户端在等待100 Continue，还没有发送报文主体，不能去读它
+		if ecr, ok := b.src.(*expectContinueReader); ok && !ecr.wroteContinue {
+			resp.closeAfterReply = true
+			return
+		}
+	}
+	_, err := io.CopyN(ioutil.Discard, r.Body, maxDiscardBytes+1)
+	if err != io.EOF {
+		resp.closeAfterReply = true
+	}
 }
 
 // 解析ContentType 并把boundary解析出来
@@ -359,7 +668,7 @@ func (r *Request) PostForm(name string) string {
 	if r.parseFormErr != nil || r.postForm == nil {
 		return ""
 	}
-	return r.postForm[name]
+	return r.postForm.Get(name)
 }
 
 // 获取文件信息
@@ -375,7 +684,7 @@ func (r *Request) MultipartForm() (*MultipartForm, error) {
 
 // 解析表单操作
 func (r *Request) parseForm() error {
-	if r.Method != "POST" && r.Method != "PUT" {
+	if r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH" {
 		return errors.New("missing form body")
 	}
 	r.haveParsedForm = true
@@ -395,8 +704,8 @@ func (r *Request) parsePostForm() error {
 	if err != nil {
 		return err
 	}
-	r.postForm = parseQuery(string(data))
-	return nil
+	r.postForm, err = parseQuery(string(data))
+	return err
 }
 
 // 解析"multipart/form-data"类型的表单 包括文字与文件的解析
@@ -406,7 +715,10 @@ func (r *Request) parseMultipartForm() error {
 		return err
 	}
 	r.multipartForm, err = mr.ReadForm()
+	if err != nil {
+		return err
+	}
 	//让PostForm方法也可以访问multipart表单的文本数据
 	r.postForm = r.multipartForm.Value
-	return err
+	return nil
 }
@@ -0,0 +1,213 @@
+package httpd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在本地随机端口上启动一个服务，测试结束时关闭
+func startServer(t *testing.T, h Handler) (*Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: h, ErrorLog: log.New(io.Discard, "", 0)}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String()
+}
+
+// 发送原始的请求数据，读取服务端在关闭连接之前写出的全部数据。
+// 服务端没有在超时之前关闭连接时closed为false
+func roundTrip(t *testing.T, addr, payload string) (resp string, closed bool) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = io.WriteString(c, payload); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := io.ReadAll(c)
+	return string(b), err == nil
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("ok"))
+	}))
+
+	tests := []struct {
+		name    string
+		payload string
+		code    string
+	}{
+		{"CL.TE", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG", "400"},
+		{"TE.CL", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 4\r\n\r\n5c\r\nGPOST / HTTP/1.1\r\n\r\n0\r\n\r\n", "400"},
+		{"empty CL with TE", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", "400"},
+		{"conflicting CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nabcde", "400"},
+		{"conflicting CL list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 5\r\n\r\nabcde", "400"},
+		{"signed CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +3\r\n\r\nabc", "400"},
+		{"negative zero CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -0\r\n\r\n", "400"},
+		{"hex CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x3\r\n\r\nabc", "400"},
+		{"space before colon", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length : 3\r\n\r\nabc", "400"},
+		{"tab before colon", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding\t: chunked\r\n\r\n0\r\n\r\n", "400"},
+		{"bare LF in request line", "GET / HTTP/1.1\nHost: a\r\n\r\n", "400"},
+		{"bare LF in header", "GET / HTTP/1.1\r\nHost: a\nX: b\r\n\r\n", "400"},
+		{"bare LF terminator", "GET / HTTP/1.1\r\nHost: a\r\n\n", "400"},
+		{"bare CR in header", "GET / HTTP/1.1\r\nHost: a\rX: b\r\n\r\n", "400"},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\r\n c\r\n\r\n", "400"},
+		{"obs-fold TE", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n", "400"},
+		{"TE gzip, chunked", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", "501"},
+		{"TE chunked twice", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", "501"},
+		{"TE identity", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: identity\r\n\r\n", "501"},
+		{"TE xchunked", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", "501"},
+		{"empty TE", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\n\r\n", "501"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, closed := roundTrip(t, addr, tt.payload)
+			if !strings.HasPrefix(resp, "HTTP/1.1 "+tt.code+" ") {
+				t.Errorf("response = %q, want status %s", resp, tt.code)
+			}
+			if !closed {
+				t.Error("connection was not closed")
+			}
+			// 被拒绝的请求之后不能再有第二个响应
+			if n := strings.Count(resp, "HTTP/1.1 "); n != 1 {
+				t.Errorf("got %d responses, want 1: %q", n, resp)
+			}
+		})
+	}
+}
+
+// 合法的请求（包括相同的重复Content-Length）仍然能在长连接上依次处理
+func TestRequestFramingAccepted(t *testing.T) {
+	_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	payload := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc" +
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nde\r\n0\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n"
+	resp, closed := roundTrip(t, addr, payload)
+	if !closed {
+		t.Fatal("connection was not closed")
+	}
+	if n := strings.Count(resp, "HTTP/1.1 200 OK"); n != 3 {
+		t.Fatalf("got %d successful responses, want 3: %q", n, resp)
+	}
+	if !strings.Contains(resp, "\r\n\r\nabc") || !strings.Contains(resp, "\r\n\r\nde") {
+		t.Errorf("bodies not echoed: %q", resp)
+	}
+}
+
+// chunk编码有误时，无论handler是否读取了报文主体，都应当回复400而不是200
+func TestBadChunkEncoding(t *testing.T) {
+	payload := "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n"
+	for _, tt := range []struct {
+		name    string
+		handler HandlerFunc
+	}{
+		{"handler reads body", func(w ResponseWriter, r *Request) {
+			io.ReadAll(r.Body)
+			w.Write([]byte("ok"))
+		}},
+		{"handler ignores body", func(w ResponseWriter, r *Request) {
+			w.Write([]byte("ok"))
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, tt.handler)
+			resp, closed := roundTrip(t, addr, payload)
+			if !strings.HasPrefix(resp, "HTTP/1.1 400 ") {
+				t.Errorf("response = %q, want status 400", resp)
+			}
+			if !strings.Contains(resp, "\r\nConnection: close\r\n") || !closed {
+				t.Errorf("connection was not closed: %q", resp)
+			}
+		})
+	}
+}
+
+func TestChunkedBody(t *testing.T) {
+	_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		// trailer只有在报文主体读到EOF之后才会出现
+		before := r.Trailer.Get("X-Sum")
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "%s|%s|%s|%s", b, before, r.Trailer.Get("X-Sum"), r.Trailer.Get("Content-Length"))
+	}))
+	const head = "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n"
+	tests := []struct {
+		name   string
+		chunks string
+		code   string
+		body   string
+	}{
+		{"extension", "1a;foo=bar\r\nabcdefghijklmnopqrstuvwxyz\r\n0\r\n\r\n", "200", "abcdefghijklmnopqrstuvwxyz|||"},
+		{"extension after BWS", "1a ;x\r\nabcdefghijklmnopqrstuvwxyz\r\n0;y=\"z\"\r\n\r\n", "200", "abcdefghijklmnopqrstuvwxyz|||"},
+		{"uppercase hex", "A\r\n0123456789\r\n0\r\n\r\n", "200", "0123456789|||"},
+		{"trailer", "3\r\nabc\r\n0\r\nX-Sum: 42\r\n\r\n", "200", "abc||42|"},
+		{"forbidden trailer dropped", "3\r\nabc\r\n0\r\nContent-Length: 9\r\nX-Sum: 1\r\n\r\n", "200", "abc||1|"},
+		{"17 hex digits", "10000000000000003\r\nabc\r\n0\r\n\r\n", "400", ""},
+		{"size over maxChunkSize", "80000000\r\nabc\r\n0\r\n\r\n", "400", ""},
+		{"illegal hex", "zz\r\nabc\r\n0\r\n\r\n", "400", ""},
+		{"missing size", ";x\r\nabc\r\n0\r\n\r\n", "400", ""},
+		{"bare LF after size", "3\nabc\r\n0\r\n\r\n", "400", ""},
+		{"missing CRLF after data", "3\r\nabcd\r\n0\r\n\r\n", "400", ""},
+		{"invalid trailer line", "3\r\nabc\r\n0\r\nX-Sum 42\r\n\r\n", "400", ""},
+		{"obs-fold in trailer", "3\r\nabc\r\n0\r\nX-Sum: 4\r\n 2\r\n\r\n", "400", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, closed := roundTrip(t, addr, head+tt.chunks)
+			if !strings.HasPrefix(resp, "HTTP/1.1 "+tt.code+" ") {
+				t.Errorf("response = %q, want status %s", resp, tt.code)
+			}
+			if !closed {
+				t.Error("connection was not closed")
+			}
+			if tt.body != "" && !strings.HasSuffix(resp, "\r\n\r\n"+tt.body) {
+				t.Errorf("response = %q, want body %q", resp, tt.body)
+			}
+		})
+	}
+}
+
+// trailer与请求首部一样受MaxHeaderBytes的约束，超出时回复431
+func TestChunkedTrailerTooLarge(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			io.ReadAll(r.Body)
+			w.Write([]byte("ok"))
+		}),
+		MaxHeaderBytes: 1 << 10,
+		ErrorLog:       log.New(io.Discard, "", 0),
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	payload := "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n" +
+		"X-Big: " + strings.Repeat("a", 8<<10) + "\r\n\r\n"
+	// 服务端没有读完请求就关闭连接，客户端可能收到RST，因此只检查响应的内容
+	resp, _ := roundTrip(t, l.Addr().String(), payload)
+	if !strings.HasPrefix(resp, "HTTP/1.1 431 ") || !strings.Contains(resp, "\r\nConnection: close\r\n") {
+		t.Errorf("response = %q, want 431 with Connection: close", resp)
+	}
+}
@@ -2,9 +2,12 @@ package httpd
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type chunkWriter struct {
@@ -22,6 +25,10 @@ func (c *chunkWriter) Write(p []byte) (n int, err error) {
 		}
 		c.wrote = true
 	}
+	//HEAD请求的响应不含报文主体，数据只用于计算Content-Length
+	if !c.resp.bodyAllowed() {
+		return len(p), nil
+	}
 	bufw := c.resp.c.bufw
 	//当Write数据超过缓存容量时，利用chunk编码传输，chunk编码格式见该系列(4)。
 	if c.resp.chunking {
@@ -72,11 +79,12 @@ func (c *chunkWriter) writeHeader() (err error) {
 	if err != nil {
 		return
 	}
-	for key, value := range c.resp.header {
-		_, err = bufw.WriteString(key + ": " + value[0] + "\r\n")
-		if err != nil {
-			return
-		}
+	//告知客户端此次响应后连接将被关闭
+	if c.resp.closeAfterReply {
+		c.resp.header.Set("Connection", "close")
+	}
+	if err = c.resp.header.write(bufw); err != nil {
+		return
 	}
 	_, err = bufw.WriteString("\r\n")
 	return
@@ -121,6 +129,15 @@ type ResponseWriter interface {
 	WriteHeader(statusCode int)
 }
 
+// 由ResponseWriter实现，允许handler接管底层的连接（例如实现WebSocket）。
+// 接管之后服务器不再读写和关闭该连接，由调用者负责关闭。
+type Hijacker interface {
+	Hijack() (net.Conn, *bufio.ReadWriter, error)
+}
+
+// 连接被接管之后再调用ResponseWriter的方法，将返回此错误
+var ErrHijacked = errors.New("httpd: connection has been hijacked")
+
 func setupResponse(c *conn, req *Request) *response {
 	resp := &response{
 		c: c,
@@ -134,14 +151,12 @@ func setupResponse(c *conn, req *Request) *response {
 	resp.cw = cw
 	resp.bufw = bufio.NewWriterSize(cw, 4096)
 
-	// 获取协议的版本 1.0 1.1
-	var (
-		protoMinor int
-		protoMajor int
-	)
-	fmt.Sscanf(req.Proto, "HTTP/%d.%d", &protoMinor, &protoMajor)
-	// 判断此次请求是否为最后一次
-	if protoMinor < 1 || protoMinor == 1 && protoMajor == 0 || req.Header.Get("Connection") == "close" {
+	// 判断此次请求是否为最后一次：HTTP/1.0或者客户端要求关闭连接
+	if req.ProtoMajor < 1 || req.ProtoMajor == 1 && req.ProtoMinor == 0 || req.Header.Get("Connection") == "close" {
+		resp.closeAfterReply = true
+	}
+	// 服务正在关闭，处理完此次请求后关闭连接
+	if c.svr.shuttingDown() {
 		resp.closeAfterReply = true
 	}
 
@@ -150,6 +165,9 @@ func setupResponse(c *conn, req *Request) *response {
 
 // 写数据
 func (w *response) Write(p []byte) (int, error) {
+	if w.c.hijacked {
+		return 0, ErrHijacked
+	}
 	n, err := w.bufw.Write(p)
 	if err != nil {
 		w.closeAfterReply = true
@@ -168,3 +186,44 @@ func (w *response) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 	w.wroteHeader = true
 }
+
+// 响应是否可以包含报文主体
+func (w *response) bodyAllowed() bool {
+	return w.req.Method != "HEAD"
+}
+
+// handler发生panic后，如果响应头部还未发送，丢弃handler已经写入缓存的数据，改为回复一个错误响应
+// 返回false表示响应头部已经发送，无法再更改响应
+func (w *response) resetForError(code int) bool {
+	if w.cw.wrote {
+		return false
+	}
+	w.bufw.Reset(w.cw)
+	w.header = make(Header)
+	w.header.Set("Content-Type", "text/plain; charset=utf-8")
+	w.statusCode = code
+	w.wroteHeader = true
+	w.closeAfterReply = true
+	w.bufw.WriteString(strconv.Itoa(code) + " " + statusText[code])
+	return true
+}
+
+// 接管底层连接，返回的ReadWriter中可能还缓存着客户端已经发送的数据。
+// 调用Hijack之前通过ResponseWriter写入的数据将被丢弃
+func (w *response) Hijack() (rwc net.Conn, buf *bufio.ReadWriter, err error) {
+	c := w.c
+	if c.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.cw.wrote {
+		return nil, nil, errors.New("httpd: Hijack after response header was written")
+	}
+	c.r.abortPendingRead()
+	if b, ok := w.req.Body.(*body); ok {
+		b.onHitEOF = nil
+	}
+	c.hijacked = true
+	c.rwc.SetDeadline(time.Time{})
+	c.setState(StateHijacked)
+	return c.rwc, bufio.NewReadWriter(c.bufr, c.bufw), nil
+}
@@ -0,0 +1,96 @@
+package httpd
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 给路由命名，名字在同一个ServeMux中必须唯一，重复时panic
+func (rt *Route) Name(name string) *Route {
+	if name == "" {
+		panic("httpd: empty route name for pattern " + rt.pattern)
+	}
+	sm := rt.mux
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if old := sm.named[name]; old != nil {
+		panic("httpd: route name " + name + " already used by pattern " + old.pattern)
+	}
+	if sm.named == nil {
+		sm.named = make(map[string]*Route)
+	}
+	if rt.name != "" {
+		delete(sm.named, rt.name)
+	}
+	rt.name = name
+	sm.named[name] = rt
+	return rt
+}
+
+// 根据命名路由的模式生成URL的路径部分，pairs依次为参数名与参数值，
+// 如mux.URL("user.show", "id", "42")。参数值按路径段转义，
+// 模式中没有的参数作为查询字符串附加在后面；缺少参数时返回错误。
+// 生成的URL不包含模式中的主机名
+func (sm *ServeMux) URL(name string, pairs ...string) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", errors.New("httpd: odd number of URL parameters for route " + name)
+	}
+	sm.mu.RLock()
+	rt := sm.named[name]
+	sm.mu.RUnlock()
+	if rt == nil {
+		return "", errors.New("httpd: no route named " + name)
+	}
+
+	params := make(map[string]string, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		params[pairs[i]] = pairs[i+1]
+	}
+	var b strings.Builder
+	for _, seg := range rt.segs {
+		b.WriteByte('/')
+		switch seg.kind {
+		case segStatic:
+			b.WriteString(url.PathEscape(seg.name))
+		case segParam:
+			v, ok := params[seg.name]
+			if !ok || v == "" {
+				return "", errors.New("httpd: missing parameter {" + seg.name + "} for route " + name)
+			}
+			if seg.check != nil && !seg.check.match(v) {
+				return "", errors.New("httpd: parameter {" + seg.name + "} value " + strconv.Quote(v) +
+					" does not satisfy constraint " + seg.check.String() + " for route " + name)
+			}
+			b.WriteString(url.PathEscape(v))
+			delete(params, seg.name)
+		case segWildcard:
+			// 子树模式的匿名通配段生成以'/'结尾的路径
+			if seg.name == "" {
+				break
+			}
+			v, ok := params[seg.name]
+			if !ok {
+				return "", errors.New("httpd: missing parameter {" + seg.name + "...} for route " + name)
+			}
+			// 通配段的值可以包含'/'，逐段转义
+			parts := strings.Split(strings.TrimPrefix(v, "/"), "/")
+			for i, part := range parts {
+				parts[i] = url.PathEscape(part)
+			}
+			b.WriteString(strings.Join(parts, "/"))
+			delete(params, seg.name)
+		}
+	}
+
+	if len(params) > 0 {
+		query := make(url.Values, len(params))
+		for k, v := range params {
+			query.Set(k, v)
+		}
+		b.WriteByte('?')
+		b.WriteString(query.Encode())
+	}
+	return b.String(), nil
+}
@@ -1,75 +1,427 @@
 package httpd
 
-import "net"
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
 
 // 处理器
 type Handler interface {
 	ServeHttp(w ResponseWriter, r *Request)
 }
 
+// handler以该值panic时，服务器中止当前响应并关闭连接，不会记录日志
+var ErrAbortHandler = errors.New("httpd: abort Handler")
+
+// 普通的函数也可以作为处理器
 type HandlerFunc func(ResponseWriter, *Request)
 
-type ServeMux struct {
-	m map[string]HandlerFunc //利用map存取路由
+func (f HandlerFunc) ServeHttp(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// 请求行与首部默认最多允许1MB
+const DefaultMaxHeaderBytes = 1 << 20
+
+// 调用Shutdown或Close之后，ListenAndServer返回此错误
+var ErrServerClosed = errors.New("httpd: Server closed")
+
+// 对应的一个服务 监听一个地址（Addr） 对应的回调函数（Handler）
+type Server struct {
+	Addr    string
+	Handler Handler
+
+	// 读取请求头部（请求行与首部）的最长时间，为0时使用ReadTimeout
+	ReadHeaderTimeout time.Duration
+	// 读取整个请求（包括报文主体）的最长时间，为0表示不限制
+	ReadTimeout time.Duration
+	// 从读完请求头部到写完响应的最长时间，为0表示不限制
+	WriteTimeout time.Duration
+	// 长连接上等待下一个请求的最长时间，为0时使用ReadTimeout
+	IdleTimeout time.Duration
+
+	// 请求行加上首部的最大字节数，为0时使用DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+
+	// ServeTLS与ListenAndServeTLS使用的TLS配置，可以为nil
+	TLSConfig *tls.Config
+
+	// 为每个listener提供基础的Context，为nil时使用context.Background()
+	BaseContext func(net.Listener) context.Context
+	// 为每个新连接修改Context，连接上所有请求的Context都派生自它，不能返回nil
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+
+	// 连接状态变化时的回调，可以用来统计或监控连接，见ConnState
+	ConnState func(net.Conn, ConnState)
+	// 同时存在的最大连接数，达到上限后暂停接收新连接，直到有连接关闭。为0表示不限制
+	MaxConns int
+	// 单个客户端IP同时存在的最大连接数，超出的连接将收到503响应并被关闭。为0表示不限制
+	MaxConnsPerIP int
+
+	// 记录服务运行中的错误，为nil时使用log包的默认Logger
+	ErrorLog *log.Logger
+
+	inShutdown atomic.Bool // 是否已经调用了Shutdown或Close
+
+	mu         sync.Mutex
+	listeners  map[*net.Listener]struct{} // 正在监听的listener
+	activeConn map[*conn]struct{}         // 尚未关闭的连接
+	doneChan   chan struct{}              // 关闭时通知accept循环退出
+	connSlots  chan struct{}              // MaxConns的信号量，每个连接占用一个
+	ipConns    map[string]int             // 每个客户端IP的连接数
 }
 
-func NewServeMux() *ServeMux {
-	return &ServeMux{
-		m: make(map[string]HandlerFunc),
+// 监听地址函数，Addr的格式见listen
+func (s *Server) ListenAndServer() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	l, err := listen(s.Addr)
+	if err != nil {
+		return err
 	}
+	return s.Serve(l)
 }
 
-func (sm *ServeMux) HandleFunc(pattern string, cb HandlerFunc) {
-	if sm.m == nil {
-		sm.m = make(map[string]HandlerFunc)
+// 在给定的listener上接收连接，并为每个连接开启一个协程处理请求
+// Serve返回时会关闭l并取消所有请求的Context。调用Shutdown或Close之后返回ErrServerClosed，
+// Accept出现非临时性的错误时返回该错误
+func (s *Server) Serve(l net.Listener) error {
+	origListener := l
+	l = &onceCloseListener{Listener: l}
+	defer l.Close()
+
+	baseCtx := context.Background()
+	if s.BaseContext != nil {
+		baseCtx = s.BaseContext(origListener)
+		if baseCtx == nil {
+			panic("httpd: BaseContext returned a nil context")
+		}
+	}
+	// 服务关闭时Serve返回，由此取消所有请求的Context
+	ctx, cancel := context.WithCancel(baseCtx)
+	defer cancel()
+
+	if !s.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+
+	// 重复循环监听端口 有tcp连接的请求就建立tcp连接 并为每个连接开启一个协程
+	var tempDelay time.Duration // Accept发生临时错误后的等待时间
+	for {
+		// 连接数达到MaxConns时暂停Accept，直到有连接关闭
+		if !s.acquireConnSlot() {
+			return ErrServerClosed
+		}
+		rwc, err := l.Accept()
+		if err != nil {
+			s.releaseConnSlot()
+			done := s.getDoneChan()
+			select {
+			case <-done:
+				return ErrServerClosed
+			default:
+			}
+			// 临时错误（如文件描述符耗尽）时等待一段时间再重试，避免空转，其他错误直接返回
+			if !isTemporaryAcceptErr(err) {
+				return err
+			}
+			if tempDelay == 0 {
+				tempDelay = acceptDelayMin
+			} else if tempDelay *= 2; tempDelay > acceptDelayMax {
+				tempDelay = acceptDelayMax
+			}
+			s.logf("httpd: Accept error: %v; retrying in %v", err, tempDelay)
+			timer := time.NewTimer(tempDelay)
+			select {
+			case <-timer.C:
+			case <-done:
+				timer.Stop()
+				return ErrServerClosed
+			}
+			continue
+		}
+		tempDelay = 0
+		// 单个IP的连接数超出MaxConnsPerIP，回复503后关闭
+		ip := remoteIP(rwc)
+		if !s.acquireIP(ip) {
+			s.releaseConnSlot()
+			go newConn(rwc, s).reject(StatusServiceUnavailable)
+			continue
+		}
+		connCtx := ctx
+		if cc := s.ConnContext; cc != nil {
+			connCtx = cc(connCtx, rwc)
+			if connCtx == nil {
+				panic("httpd: ConnContext returned nil")
+			}
+		}
+		c := newConn(rwc, s)
+		c.remoteIP = ip
+		c.setState(StateNew)
+		go c.serve(connCtx) // 为每一个连接开启一个go程
 	}
-	sm.m[pattern] = cb
 }
 
-func (sm *ServeMux) Handle(pattern string, handler Handler) {
-	if sm.m == nil {
-		sm.m = make(map[string]HandlerFunc)
+// Accept临时错误后重试的等待时间，从acceptDelayMin开始翻倍，最多acceptDelayMax
+const (
+	acceptDelayMin = 5 * time.Millisecond
+	acceptDelayMax = 1 * time.Second
+)
+
+// 判断Accept的错误是否是临时的，重试有可能成功
+func isTemporaryAcceptErr(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
 	}
-	sm.m[pattern] = handler.ServeHttp
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
 }
 
-func (sm *ServeMux) ServeHttp(w ResponseWriter, r *Request) {
-	// 查看路由表项是否存在对应entry
-	handler, ok := sm.m[r.URL.Path]
-	if !ok {
-		if len(r.URL.Path) > 1 && r.URL.Path[len(r.URL.Path)-1] == '/' {
-			handler, ok = sm.m[r.URL.Path[:len(r.URL.Path)-1]]
+// 轮询空闲连接的最大间隔
+const shutdownPollIntervalMax = 500 * time.Millisecond
+
+// 优雅关闭：先关闭所有listener停止接收新连接，然后关闭所有空闲连接，
+// 并等待正在处理请求的连接处理完当前请求后自行关闭。
+// 所有连接都关闭后返回；如果ctx先到期，则返回ctx的错误，此时仍未关闭的连接不会被强制关闭。
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	lnerr := s.closeListenersLocked()
+	s.closeDoneChanLocked()
+	s.mu.Unlock()
+
+	// 轮询间隔从1ms开始翻倍，直到shutdownPollIntervalMax
+	pollInterval := time.Millisecond
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+	for {
+		if s.closeIdleConns() {
+			return lnerr
 		}
-		if !ok {
-			w.WriteHeader(StatusNotFound)
-			return
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			if pollInterval *= 2; pollInterval > shutdownPollIntervalMax {
+				pollInterval = shutdownPollIntervalMax
+			}
+			timer.Reset(pollInterval)
 		}
 	}
-	handler(w, r)
 }
 
-// 对应的一个服务 监听一个地址（Addr） 对应的回调函数（Handler）
-type Server struct {
-	Addr    string
-	Handler Handler
+// 立即关闭：关闭所有listener以及所有连接，不等待正在处理的请求
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeDoneChanLocked()
+	err := s.closeListenersLocked()
+	for c := range s.activeConn {
+		c.rwc.Close()
+		delete(s.activeConn, c)
+	}
+	return err
 }
 
-// 监听地址函数
-func (s *Server) ListenAndServer() error {
-	// tcp监听
-	listen, err := net.Listen("tcp", s.Addr)
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
 
-	if err != nil {
-		return err
+func (s *Server) maxHeaderBytes() int64 {
+	if s.MaxHeaderBytes > 0 {
+		return int64(s.MaxHeaderBytes)
+	}
+	return DefaultMaxHeaderBytes
+}
+
+func (s *Server) readHeaderTimeout() time.Duration {
+	if s.ReadHeaderTimeout != 0 {
+		return s.ReadHeaderTimeout
 	}
+	return s.ReadTimeout
+}
 
-	// 重复循环监听端口 有tcp连接的请求就建立tcp连接 并为每个连接开启一个协程
-	for {
-		rwc, err := listen.Accept()
-		if err != nil {
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout != 0 {
+		return s.IdleTimeout
+	}
+	return s.ReadTimeout
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// 关闭所有空闲的连接，返回是否所有连接都已关闭
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quiescent := true
+	for c := range s.activeConn {
+		st, unixSec := c.getState()
+		// 建立了连接却迟迟不发送请求的客户端，也视为空闲
+		if st == StateNew && unixSec < time.Now().Unix()-5 {
+			st = StateIdle
+		}
+		if st != StateIdle || unixSec == 0 {
+			quiescent = false
 			continue
 		}
-		c := newConn(rwc, s)
-		go c.serve() // 为每一个连接开启一个go程
+		c.rwc.Close()
+		delete(s.activeConn, c)
+	}
+	return quiescent
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for ln := range s.listeners {
+		if cerr := (*ln).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, ln)
+	}
+	return err
+}
+
+func (s *Server) getDoneChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getDoneChanLocked()
+}
+
+func (s *Server) getDoneChanLocked() chan struct{} {
+	if s.doneChan == nil {
+		s.doneChan = make(chan struct{})
+	}
+	return s.doneChan
+}
+
+func (s *Server) closeDoneChanLocked() {
+	ch := s.getDoneChanLocked()
+	select {
+	case <-ch:
+		// 已经关闭过了
+	default:
+		close(ch)
+	}
+}
+
+// 登记或注销listener，服务已关闭时登记失败返回false
+func (s *Server) trackListener(ln *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+// 占用一个连接名额，服务关闭时返回false
+func (s *Server) acquireConnSlot() bool {
+	if s.MaxConns <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	if s.connSlots == nil {
+		s.connSlots = make(chan struct{}, s.MaxConns)
+	}
+	slots := s.connSlots
+	done := s.getDoneChanLocked()
+	s.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (s *Server) releaseConnSlot() {
+	if s.MaxConns <= 0 {
+		return
+	}
+	<-s.connSlots
+}
+
+// 为ip增加一个连接计数，超出MaxConnsPerIP时返回false
+func (s *Server) acquireIP(ip string) bool {
+	if s.MaxConnsPerIP <= 0 || ip == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ipConns == nil {
+		s.ipConns = make(map[string]int)
+	}
+	if s.ipConns[ip] >= s.MaxConnsPerIP {
+		return false
+	}
+	s.ipConns[ip]++
+	return true
+}
+
+func (s *Server) releaseIP(ip string) {
+	if s.MaxConnsPerIP <= 0 || ip == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+}
+
+// 取得连接对端的IP，非IP连接（如unix socket）返回空字符串
+func remoteIP(rwc net.Conn) string {
+	switch addr := rwc.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// 登记或注销连接
+func (s *Server) trackConn(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.activeConn == nil {
+		s.activeConn = make(map[*conn]struct{})
+	}
+	if add {
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
 	}
 }
@@ -0,0 +1,104 @@
+package httpd
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handler执行期间开始Shutdown时，响应需要带上"Connection: close"，之后服务端关闭连接
+func TestShutdownClosesInFlightConn(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		close(started)
+		<-release
+		w.Write([]byte("ok"))
+	}))
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	<-started
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	// 等待Shutdown标记服务正在关闭后再让handler返回
+	for !s.shuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("connection was not closed: %v", err)
+	}
+	resp := string(b)
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 ") || !strings.Contains(resp, "\r\nConnection: close\r\n") {
+		t.Errorf("response = %q, want 200 with Connection: close", resp)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Shutdown did not return")
+	}
+}
+
+// handler无论正常返回、panic、中止还是接管连接，解析表单产生的临时文件都要被删除
+func TestTempFilesRemoved(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		after func(w ResponseWriter)
+	}{
+		{"return", func(w ResponseWriter) {}},
+		{"panic after write", func(w ResponseWriter) {
+			w.Write(make([]byte, 8<<10))
+			panic("boom")
+		}},
+		{"abort", func(w ResponseWriter) { panic(ErrAbortHandler) }},
+		{"hijack", func(w ResponseWriter) {
+			rwc, _, err := w.(Hijacker).Hijack()
+			if err == nil {
+				rwc.Close()
+			}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := filepath.Join(t.TempDir(), "multipart-upload")
+			if err := os.WriteFile(tmp, []byte("data"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			handled := make(chan struct{})
+			_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+				defer close(handled)
+				// 相当于FormFile解析了一个超出内存限制、存放在磁盘上的文件
+				r.multipartForm = &MultipartForm{File: map[string]*FileHeader{"f": {tmpFile: tmp}}}
+				tt.after(w)
+			}))
+			roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+			<-handled
+			// 连接关闭与删除文件之间没有先后保证，稍等片刻
+			deadline := time.Now().Add(time.Second)
+			for {
+				if _, err := os.Stat(tmp); os.IsNotExist(err) {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("temp file %s was not removed", tmp)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
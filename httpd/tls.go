@@ -0,0 +1,251 @@
+package httpd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 监听地址并提供HTTPS服务，certFile与keyFile为PEM格式的证书与私钥文件。
+// 如果TLSConfig中已经配置了Certificates或GetCertificate，两个文件名必须为空，
+// 否则返回错误；需要同时使用多张证书时可以将它们都加入CertStore。
+// 通过文件名给出的证书在文件更新后会被自动重新加载，无需重启服务。
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	l, err := listen(s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// 在给定的listener上提供HTTPS服务，参数含义同ListenAndServeTLS，返回时会关闭l
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := s.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if !containsString(config.NextProtos, "http/1.1") {
+		config.NextProtos = append(config.NextProtos, "http/1.1")
+	}
+	configured := len(config.Certificates) > 0 || config.GetCertificate != nil
+	if configured && (certFile != "" || keyFile != "") {
+		l.Close()
+		return errors.New("httpd: certFile and keyFile must be empty when TLSConfig has Certificates or GetCertificate")
+	}
+	if !configured {
+		store := NewCertStore()
+		if err := store.Add(certFile, keyFile); err != nil {
+			l.Close()
+			return err
+		}
+		config.GetCertificate = store.GetCertificate
+	}
+	return s.Serve(tls.NewListener(l, config))
+}
+
+// 完成TLS握手，握手受读取头部与写响应的超时约束
+func (c *conn) handshake(tlsConn *tls.Conn) bool {
+	if d := c.svr.readHeaderTimeout(); d != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+	}
+	if d := c.svr.WriteTimeout; d != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(d))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		// 客户端向HTTPS端口发送了明文的HTTP请求
+		var re tls.RecordHeaderError
+		if errors.As(err, &re) && re.Conn != nil && looksLikeHTTP(re.RecordHeader) {
+			re.Conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\nClient sent an HTTP request to an HTTPS server.\n"))
+			re.Conn.Close()
+			return false
+		}
+		c.svr.logf("httpd: TLS handshake error from %s: %v", c.rwc.RemoteAddr(), err)
+		return false
+	}
+	state := tlsConn.ConnectionState()
+	c.tlsState = &state
+	return true
+}
+
+// 判断TLS记录头的5个字节是否像是一个HTTP请求的开头
+func looksLikeHTTP(hdr [5]byte) bool {
+	switch string(hdr[:]) {
+	case "GET /", "HEAD ", "POST ", "PUT /", "OPTIO":
+		return true
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 两次检查证书文件是否更新的最短间隔
+const certCheckInterval = 5 * time.Second
+
+// 证书仓库：根据SNI为不同的域名选择证书，并在证书文件更新后自动重新加载。
+// 将GetCertificate设置到tls.Config中即可使用：
+//
+//	store := httpd.NewCertStore()
+//	store.Add("a.example.com.crt", "a.example.com.key")
+//	store.Add("b.example.com.crt", "b.example.com.key")
+//	svr.TLSConfig = &tls.Config{GetCertificate: store.GetCertificate}
+//	svr.ListenAndServeTLS("", "")
+type CertStore struct {
+	mu      sync.RWMutex
+	entries []*certEntry
+	// 上次检查证书文件的时间，unix纳秒
+	lastCheck atomic.Int64
+}
+
+// 一对证书与私钥文件
+type certEntry struct {
+	certFile, keyFile string
+	// 两个文件中较新的修改时间，用于判断是否需要重新加载
+	modTime time.Time
+	cert    *tls.Certificate
+	// 证书适用的域名，可能包含"*.example.com"形式的通配域名
+	names []string
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{}
+}
+
+// 加载一对证书与私钥文件，先加入的证书在没有域名匹配时作为默认证书
+func (cs *CertStore) Add(certFile, keyFile string) error {
+	e := &certEntry{certFile: certFile, keyFile: keyFile}
+	modTime, err := e.filesModTime()
+	if err != nil {
+		return err
+	}
+	if err = e.load(modTime); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	cs.entries = append(cs.entries, e)
+	cs.mu.Unlock()
+	return nil
+}
+
+// 重新加载所有修改过的证书文件，加载失败的证书继续使用旧的版本，返回遇到的第一个错误
+func (cs *CertStore) Reload() error {
+	cs.lastCheck.Store(time.Now().UnixNano())
+
+	cs.mu.RLock()
+	entries := cs.entries
+	cs.mu.RUnlock()
+
+	var firstErr error
+	for _, e := range entries {
+		modTime, err := e.filesModTime()
+		if err == nil {
+			cs.mu.RLock()
+			changed := !modTime.Equal(e.modTime)
+			cs.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			// load会替换掉e中的证书，需要加写锁
+			ne := &certEntry{certFile: e.certFile, keyFile: e.keyFile}
+			if err = ne.load(modTime); err == nil {
+				cs.mu.Lock()
+				e.modTime, e.cert, e.names = ne.modTime, ne.cert, ne.names
+				cs.mu.Unlock()
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// 供tls.Config.GetCertificate使用，根据客户端发送的SNI选择证书
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// 距离上次检查超过certCheckInterval，顺便检查证书文件是否更新
+	if last := cs.lastCheck.Load(); time.Since(time.Unix(0, last)) >= certCheckInterval &&
+		cs.lastCheck.CompareAndSwap(last, time.Now().UnixNano()) {
+		cs.Reload()
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if len(cs.entries) == 0 {
+		return nil, errors.New("httpd: no certificates configured")
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		for _, e := range cs.entries {
+			if e.matches(name) {
+				return e.cert, nil
+			}
+		}
+	}
+	return cs.entries[0].cert, nil
+}
+
+func (e *certEntry) filesModTime() (time.Time, error) {
+	cfi, err := os.Stat(e.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	kfi, err := os.Stat(e.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if kfi.ModTime().After(cfi.ModTime()) {
+		return kfi.ModTime(), nil
+	}
+	return cfi.ModTime(), nil
+}
+
+func (e *certEntry) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	e.modTime, e.cert, e.names = modTime, &cert, nil
+	for _, n := range names {
+		e.names = append(e.names, strings.ToLower(n))
+	}
+	return nil
+}
+
+// 判断证书是否适用于name，通配域名只匹配一级子域名
+func (e *certEntry) matches(name string) bool {
+	for _, n := range e.names {
+		if n == name {
+			return true
+		}
+		if strings.HasPrefix(n, "*.") {
+			if i := strings.IndexByte(name, '.'); i > 0 && name[i:] == n[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
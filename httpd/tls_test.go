@@ -0,0 +1,206 @@
+package httpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 生成一张自签名证书，写入dir下的name.crt与name.key，返回两个文件名
+func writeSelfSignedCert(t *testing.T, dir, name string, serial int64, dnsNames ...string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// 以serverName发起TLS连接并发送一个请求，返回服务端证书的序列号与响应的报文主体
+func tlsGet(t *testing.T, addr, serverName string) (serial int64, body string) {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial %s: %v", serverName, err)
+	}
+	defer c.Close()
+	serial = c.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", serverName)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("read %s: %v", serverName, err)
+	}
+	resp := string(b)
+	if i := strings.Index(resp, "\r\n\r\n"); i >= 0 {
+		body = resp[i+4:]
+	}
+	return
+}
+
+func TestServeTLSWithCertStore(t *testing.T) {
+	dir := t.TempDir()
+	aCert, aKey := writeSelfSignedCert(t, dir, "a", 1, "a.test")
+	bCert, bKey := writeSelfSignedCert(t, dir, "b", 2, "*.b.test")
+	store := NewCertStore()
+	if err := store.Add(aCert, aKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(bCert, bKey); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			if r.TLS == nil {
+				w.Write([]byte("no tls"))
+				return
+			}
+			fmt.Fprintf(w, "%s %v", r.TLS.ServerName, r.TLS.HandshakeComplete)
+		}),
+		TLSConfig: &tls.Config{GetCertificate: store.GetCertificate},
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go s.ServeTLS(l, "", "")
+	t.Cleanup(func() { s.Close() })
+	addr := l.Addr().String()
+
+	// 按SNI选择证书，通配证书只匹配一级子域名，没有匹配时使用第一张证书
+	for _, tt := range []struct {
+		serverName string
+		serial     int64
+	}{
+		{"a.test", 1},
+		{"x.b.test", 2},
+		{"X.B.TEST", 2},
+		{"y.x.b.test", 1},
+		{"unknown.test", 1},
+	} {
+		serial, body := tlsGet(t, addr, tt.serverName)
+		if serial != tt.serial {
+			t.Errorf("%s: got cert serial %d, want %d", tt.serverName, serial, tt.serial)
+		}
+		if want := tt.serverName + " true"; body != want {
+			t.Errorf("%s: Request.TLS reported %q, want %q", tt.serverName, body, want)
+		}
+	}
+
+	// 重写a的证书并把修改时间推后，模拟部署新证书
+	aCert, aKey = writeSelfSignedCert(t, dir, "a", 3, "a.test")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{aCert, aKey} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 距离上次检查不到certCheckInterval时继续使用旧证书
+	if serial, _ := tlsGet(t, addr, "a.test"); serial != 1 {
+		t.Errorf("before check interval: got cert serial %d, want 1", serial)
+	}
+	// 让下一次握手认为已经过了检查间隔，从而重新加载证书
+	store.lastCheck.Store(0)
+	if serial, _ := tlsGet(t, addr, "a.test"); serial != 3 {
+		t.Errorf("after reload: got cert serial %d, want 3", serial)
+	}
+	if serial, _ := tlsGet(t, addr, "x.b.test"); serial != 2 {
+		t.Errorf("unchanged cert: got serial %d, want 2", serial)
+	}
+}
+
+// 向HTTPS端口发送明文请求时回复400而不是直接断开
+func TestServeTLSPlainHTTP(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir, "a", 1, "a.test")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {}), ErrorLog: log.New(io.Discard, "", 0)}
+	go s.ServeTLS(l, certFile, keyFile)
+	t.Cleanup(func() { s.Close() })
+
+	resp, closed := roundTrip(t, l.Addr().String(), "GET / HTTP/1.1\r\nHost: a.test\r\n\r\n")
+	if !strings.HasPrefix(resp, "HTTP/1.0 400 ") {
+		t.Errorf("response = %q, want 400", resp)
+	}
+	if !closed {
+		t.Error("connection was not closed")
+	}
+}
+
+// TLSConfig中已经配置了证书时，不能再通过文件名给出证书，否则文件会被忽略
+func TestServeTLSConfiguredCertAndFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir, "a", 1, "a.test")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []*tls.Config{
+		{Certificates: []tls.Certificate{cert}},
+		{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil }},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {}), TLSConfig: config}
+		done := make(chan error, 1)
+		go func() { done <- s.ServeTLS(l, certFile, keyFile) }()
+		select {
+		case err = <-done:
+			if err == nil || !strings.Contains(err.Error(), "must be empty") {
+				t.Errorf("ServeTLS = %v, want error about certFile and keyFile", err)
+			}
+		case <-time.After(2 * time.Second):
+			s.Close()
+			t.Fatal("ServeTLS did not return")
+		}
+		// 返回错误时listener已经被关闭
+		if _, err = net.Dial("tcp", l.Addr().String()); err == nil {
+			t.Error("listener was not closed")
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package httpd
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// 查询字符串或表单中的参数，同一个参数名可以对应多个值，按出现的顺序排列
+type Values map[string][]string
+
+// 取得参数的第一个值，参数不存在时返回空
+func (v Values) Get(key string) string {
+	vs := v[key]
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
+
+// 将参数设置为单个值，替换原有的值
+func (v Values) Set(key, value string) {
+	v[key] = []string{value}
+}
+
+// 给参数追加一个值
+func (v Values) Add(key, value string) {
+	v[key] = append(v[key], value)
+}
+
+func (v Values) Del(key string) {
+	delete(v, key)
+}
+
+// 参数是否存在，值为空的参数（如"?flag="或"?flag"）同样存在
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// 编码成"a=1&b=2"的形式，按参数名排序
+func (v Values) Encode() string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		ek := url.QueryEscape(k)
+		for _, value := range v[k] {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(ek)
+			b.WriteByte('=')
+			b.WriteString(url.QueryEscape(value))
+		}
+	}
+	return b.String()
+}
+
+// 解析查询字符串与application/x-www-form-urlencoded格式的表单：
+// 以'&'分隔参数，以第一个'='分隔参数名与值，两者都按百分号编码解码并将'+'解码为空格。
+// 无法解码的参数会被跳过，返回遇到的第一个错误
+func parseQuery(query string) (Values, error) {
+	values := make(Values)
+	var firstErr error
+	for query != "" {
+		var part string
+		part, query, _ = strings.Cut(query, "&")
+		if part == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(part, "=")
+		key, err := url.QueryUnescape(key)
+		if err == nil {
+			value, err = url.QueryUnescape(value)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		values.Add(key, value)
+	}
+	return values, firstErr
+}
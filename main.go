@@ -1,6 +1,13 @@
 package main
 
 import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"my-http/httpd"
 )
 
@@ -14,5 +21,24 @@ func main() {
 		Addr:    "127.0.0.1:8080",
 		Handler: sm,
 	}
-	panic(svr.ListenAndServer())
+
+	// 收到退出信号后优雅关闭，最多等待10秒让正在处理的请求完成
+	idleConnsClosed := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := svr.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		close(idleConnsClosed)
+	}()
+
+	if err := svr.ListenAndServer(); err != httpd.ErrServerClosed {
+		panic(err)
+	}
+	<-idleConnsClosed
 }